@@ -5,6 +5,7 @@
 package backup
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,6 +13,8 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/eddyueue/go-exasol-client"
 	"github.com/sirupsen/logrus"
@@ -39,8 +42,16 @@ const (
 type Conf struct {
 	// Exasol instance to backup from
 	Source *exasol.Conn
+	// Alternatively to Source a ConnectionFactory can be specified
+	// in which case the connection is opened and closed by the backup.
+	ConnectionFactory func() (*exasol.Conn, error)
 	// Local filesystem directory underwhich to store the backup
 	Destination string
+	// If set then the backup is stored under this relative path within
+	// the Destination e.g. "prod" so that several databases can share one
+	// Destination. Everything (including DropExtras) stays within it.
+	// The paths passed to OnFileWritten include the prefix.
+	DestinationPrefix string
 	// The list of object types to backup
 	Objects []Object
 
@@ -55,27 +66,419 @@ type Conf struct {
 	// Skip is the inverse of Match.
 	// Any schema objects matching it will be skipped.
 	Skip string
+	// Exasol's own system schemas (SYS and EXA_STATISTICS)
+	// are always skipped unless this is true.
+	IncludeSystemObjects bool
 
 	// If > 0 then tables with this many or fewer rows
 	// will have the their data backed up to CSV files.
-	// If 0 then no table data will be backed up.
+	// If 0 then no table data will be backed up. Tables whose
+	// data is left out for having too many rows are listed in
+	// manifest.json.
 	MaxTableRows int
+	// TableRowLimits maps "schema.table" to a row limit overriding
+	// MaxTableRows for that table. 0 means no data is backed up and
+	// a negative limit means all of the table's data is backed up.
+	TableRowLimits map[string]int
+	// If true then no data file is kept for a table whose data export
+	// returned no rows, e.g. because of DataWhereByColumn.
+	// Tables which are empty to begin with never get a data file.
+	// Tables left without a data file this way are marked as empty
+	// in manifest.json.
+	SkipEmptyTablesData bool
+	// If > 0 then each table's/view's data is split into CSV files of at
+	// most this many rows named <name>.000.csv, <name>.001.csv, etc.
+	// Rows are never split across files. The rows are split by the
+	// DataExportHints' ROW SEPARATOR and any column names row (WITH
+	// COLUMN NAMES) is repeated at the start of each file.
+	MaxRowsPerFile int
+	// Controls how tables with more than MaxTableRows rows are handled.
+	// By default their data isn't backed up at all. Otherwise a sample
+	// of MaxTableRows rows is backed up: the first rows (by primary key),
+	// random rows or every k-th row (by primary key). Each sampled
+	// table is recorded in manifest.json.
+	DataSampleStrategy DataSample // Defaults to NO_SAMPLE
 	// If > 0 then views with this many or fewer rows
 	// will have the their data backed up to CSV files.
 	// If 0 then no view data will be backed up.
 	MaxViewRows int
+	// DataWhereByColumn maps a column name to a SQL predicate.
+	// When backing up table/view data the predicate is applied
+	// to any table/view having that column. e.g.
+	//   {"TENANT_ID": "TENANT_ID IN (1, 2)"}
+	// Tables/views lacking the column are backed up in full.
+	DataWhereByColumn map[string]string
+	// DataQueryTransform, if set, is called for each table/view whose data
+	// is being backed up and can return a custom select list to use
+	// in place of the table's/view's columns. e.g.
+	//   "A, LENGTH(BIG_BLOB) AS BIG_BLOB"
+	// If it returns false then the columns are backed up as-is.
+	DataQueryTransform func(schema, object string, cols []Column) (selectList string, ok bool)
+	// DataSink, if set, receives each table's data (as CSV-parsed rows)
+	// instead of it being written to a CSV file. The header lists the
+	// table's column names. The rows are subject to the same MaxTableRows,
+	// DataWhereByColumn, etc. as the CSV files would be.
+	// Returning an error fails the backup. View data is unaffected.
+	DataSink func(schema, table string, header []string, rows <-chan []string) error
+	// NoDataColumnTypes lists column types (e.g. "GEOMETRY", "HASHTYPE")
+	// whose data isn't backed up. Such columns are exported as NULL
+	// (i.e. empty CSV fields) so the CSV columns still line up with the DDL.
+	// DataQueryTransform takes precedence for the objects it handles.
+	NoDataColumnTypes []string
+	// If true then columns of types the CSV export isn't known to represent
+	// faithfully (i.e. any but Exasol's standard data types) are exported
+	// as NULL like NoDataColumnTypes. Each is recorded as a warning for its
+	// table/view in manifest.json. With StrictMode they fail the backup.
+	DataExportNullForUnsupportedTypes bool
+	// DataColumnOrder maps "schema.table" to the order of the columns
+	// in that table's data (and DataSink header). Any of the table's
+	// columns not listed follow in the DDL's order unless
+	// DataColumnOrderOnly is set in which case they're left out.
+	// The DDL itself keeps the catalog's order. View data is unaffected.
+	DataColumnOrder     map[string][]string
+	DataColumnOrderOnly bool
+	// DataExportHints maps "schema.object" to a clause appended to the
+	// EXPORT statement backing up that table's/view's data. e.g.
+	//   {"SALES.ORDERS": "BOOLEAN = 'yes/no'"}
+	// This is meant for tuning specific problem tables. The clause may only
+	// be made up of the EXPORT file options NULL, BOOLEAN, ROW SEPARATOR,
+	// COLUMN SEPARATOR, COLUMN DELIMITER, DELIMIT and WITH COLUMN NAMES.
+	// With a DataSink the CSV format (separators, delimiter and column
+	// names) can't be changed.
+	DataExportHints map[string]string
+	// ExportNLS overrides the session NLS settings used when
+	// backing up table/view data. e.g.
+	//   {"NLS_TIMESTAMP_FORMAT": "YYYY-MM-DD HH24:MI:SS.FF6"}
+	// By default ISO date/timestamp formats are used. The settings in
+	// effect are backed up to session.sql so that the data can be
+	// loaded back under the same settings.
+	ExportNLS map[string]string
+	// The session time zone used when backing up table/view data.
+	// This affects TIMESTAMP WITH LOCAL TIME ZONE data.
+	// Defaults to the database's TIME_ZONE.
+	ExportTimeZone string
+	// The character encoding of the table/view data files e.g. "LATIN1".
+	// Defaults to UTF-8. The data is transcoded as it's written and the
+	// encoding is recorded in manifest.json. The data has to be imported
+	// back with the same ENCODING. The DDL files are always UTF-8.
+	OutputEncoding string
+	// What to do with data which can't be represented in the OutputEncoding
+	EncodingErrorMode EncodingErrorMode // Defaults to ENCODING_ERROR
+
+	// The size of the buffer used when writing table/view data files.
+	// Larger buffers reduce the number of writes which helps
+	// on network filesystems.
+	WriteBufferSize int // Defaults to 1MB
+
+	// GroupRemap renames the consumer/priority groups referenced by the
+	// backed up users/roles. e.g. {"HIGH": "MEDIUM"}
+	// This allows restoring into an instance with a different group layout.
+	// The groups themselves are still backed up as-is.
+	GroupRemap map[string]string
+	// If true then user/role references to groups not
+	// in GroupRemap are left out of the backup.
+	DropUnmappedGroups bool
+
+	// If true then each generated .sql file starts with a comment
+	// noting the source host and the object(s) the file is for.
+	FileHeader bool
+	// If true then the FileHeader also includes the backup's start time.
+	// This is off by default so that unchanged objects produce
+	// unchanged files.
+	FileHeaderTimestamp bool
+
+	// OnFileWritten, if set, is called with the path (relative to the
+	// Destination), size and sha256 checksum of each file once it has
+	// been completely written. A backup's calls are serialized so
+	// it needn't be safe for concurrent use unless it's shared by
+	// concurrent backups.
+	OnFileWritten func(relPath string, size int64, checksum string)
+
+	// OnStart, if set, is called once before anything is backed up with
+	// the resolved Plan. OnFinish, if set, is called exactly once when
+	// the backup ends with a Summary and the backup's error (if any)
+	// including when it aborts early (even on an invalid Conf, in which
+	// case OnStart isn't called) or panics.
+	OnStart  func(Plan)
+	OnFinish func(Summary, error)
+
+	// If set then each file is encrypted (AES-256-GCM in 64KiB segments)
+	// as it's written to a <file>.enc file so no plaintext is ever left
+	// in the Destination, even if the backup fails. The OnFileWritten
+	// paths are the .enc ones and a manifest.json lists the encrypted
+	// files. OpenBackupFile reads them transparently and DecryptBackup
+	// decrypts a backup in place.
+	Encrypt *EncryptConfig
+
+	// If true then when backing up USERS a role_suggestions.json file is
+	// also written proposing roles which would consolidate the privileges
+	// granted directly to several users. It's only advisory. The users'
+	// own grants are still backed up as-is.
+	NormalizePrivilegesToRoles bool
+
+	// If true then the parameters, groups, connections, roles and users
+	// are each backed up concurrently on their own connection (from the
+	// ConnectionFactory, which is then required) while the schema objects
+	// are backed up on the Source.
+	ParallelObjectTypes bool
+
+	// ObjectFilter, if set, is called for each schema, table, view,
+	// script and function matching the Match/Skip criteria. Returning
+	// false skips the object's DDL and data. Like objects not matching
+	// the criteria, DropExtras leaves the files of skipped objects alone.
+	ObjectFilter func(o DiscoveredObject) bool
+
+	// Metrics, if set, receives aggregate measurements of the backup
+	// (per object type durations, counts and errors plus the bytes
+	// written) e.g. to export them to Prometheus.
+	Metrics Metrics
+
+	// SchemaOrder lists the schemas to be backed up first, in that order.
+	// The objects of the other schemas follow sorted by schema name.
+	SchemaOrder []string
+
+	// If true (Default) then each file is written to a <file>.tmp which
+	// is then renamed into place so that the backed up files are never
+	// seen partially written and a failed write doesn't replace the
+	// previous file. Set it to false for filesystems where renames are
+	// costly.
+	AtomicWrites *bool
 
 	// If true then any text files existing in the destination
 	// but no longer existing in Exasol will be removed.
 	// If false then the backup is purely additive
 	DropExtras bool
 
+	// If true then only the schemas themselves are backed up along with
+	// a lightweight inventory.json listing the names/types/counts of the
+	// objects under them. No per-object DDL or data is generated.
+	// Non-schema objects (users, roles, connections, parameters) are
+	// still backed up according to Objects.
+	SchemasOnly bool
+
+	// If true then the DDL is backed up but no query reading the objects'
+	// data (exports, view row counts, etc.) is ever run against the source.
+	// Only the catalog is queried. i.e. MaxTableRows and MaxViewRows are
+	// treated as 0 and invalid views can't be told apart so they're
+	// always included.
+	ListOnly bool
+
+	// If true then a database_info.json file is written recording the
+	// source's product name/version (from EXA_METADATA) and its enabled
+	// script languages. This is informational and isn't restored.
+	EmitDatabaseInfo bool
+
+	// If true then a comments.json file is written per schema mapping
+	// each object/column to its comment. This is purely informational
+	// for docs tooling. The comments are still included in the DDL.
+	// Objects skipped by ObjectFilter are left out and RenameFunc
+	// applies as it does for the DDL.
+	EmitCommentsJSON bool
+
+	// If true then when backing up TABLES a distribution_stats.json file
+	// is written recording the rows per node of each table with a
+	// DISTRIBUTE BY key and how skewed they are. This is informational
+	// and isn't restored. It counts the tables' rows so ListOnly turns
+	// it off.
+	CaptureDistributionStats bool
+
+	// If true then the foreign keys are left out of the table DDL and
+	// are instead backed up as ALTER TABLE statements to a constraints.sql
+	// file per schema. Applying it after all of the tables have been
+	// created allows restoring tables which reference each other.
+	DeferConstraints bool
+
+	// If true then a _schema.sql file is written per schema containing
+	// the DDL of all of the schema's backed up objects in an order which
+	// can be applied in one go. Foreign keys are added last via ALTER TABLE
+	// so that tables referencing each other can be restored.
+	EmitSchemaBundle bool
+
+	// If true (Default) then an object which is dropped after
+	// being listed but before its data is backed up is logged
+	// and skipped rather than failing the whole backup.
+	IgnoreMissingObjects *bool
+
+	// If true (Default) then views which are currently invalid (e.g. a
+	// FORCE view whose underlying table was dropped) are still backed up
+	// from their stored text. Their data can't be queried so it's skipped.
+	// If false then invalid views are skipped entirely.
+	IncludeInvalidViews *bool
+
+	// If true (Default) then PARAMETERS backs up every system parameter.
+	// If false then only those whose value differs from Exasol's
+	// documented default for the Exasol version are backed up. Parameters
+	// set up at installation (e.g. TIME_ZONE and SCRIPT_LANGUAGES) or
+	// without a documented default are always backed up.
+	AllParameters *bool
+
+	// If > 0 then the data of any table/view whose data queries take
+	// longer than this is logged and skipped. It's enforced by setting
+	// the session's QUERY_TIMEOUT just while the data queries run so
+	// it's rounded up to whole seconds. Skipped tables are marked as
+	// such in manifest.json.
+	ObjectTimeout time.Duration
+
+	// If true then anything which would otherwise be logged and skipped
+	// fails the backup instead. Namely:
+	//  - Objects dropped while being backed up (i.e. IgnoreMissingObjects is false)
+	//  - The data of invalid views
+	//  - Data queries running into ObjectTimeout
+	//  - Requesting PRIORITY_GROUPS/CONSUMER_GROUPS from an Exasol
+	//    version that only has the other
+	//  - Columns of unsupported types with DataExportNullForUnsupportedTypes
+	StrictMode bool
+
+	// If true and the prior backup to the Destination did not finish
+	// then any table/view data files it completed (and which are
+	// unchanged since) are not backed up again. Split data is only
+	// skipped if it was split by the same MaxRowsPerFile. Only runs
+	// with Resume track their progress so they're the only ones which
+	// can be resumed.
+	Resume bool
+
+	// If true then the backed up scripts are scanned for IMPORT/EXPORT
+	// statements and an external_dependencies.json file is written
+	// mapping each script to the connections and external tables
+	// it uses. Only the SQL strings scripting programs pass to
+	// query()/pquery() are scanned (not comments or UDF/adapter
+	// scripts). This is informational only and best-effort. Like the
+	// script files it's subject to ObjectFilter, RenameFunc and NameCase.
+	AnalyzeImports bool
+
+	// Controls where the database-global objects (users, roles,
+	// connections, parameters and groups) are backed up to.
+	// Schema objects are always backed up under schemas/.
+	Layout Layout // Defaults to FLAT_LAYOUT
+
+	// Controls how the identifiers in the generated SQL are quoted.
+	// By default both "..." and [...] are used depending on the statement.
+	// Connection names are always left unquoted.
+	IdentifierQuote IdentifierQuote // Defaults to MIXED_QUOTES
+
+	// Controls the case of the generated file/directory names.
+	// The identifiers within the backed up SQL are left untouched.
+	NameCase NameCase // Defaults to PRESERVE_CASE
+
+	// RenameFunc, if set, is called for each schema, table, view, script
+	// and function to get the schema and name it should be backed up as.
+	// (For SCHEMAS the name is "".) The new names are used both for the
+	// files/directories and for the object's identifiers in the generated
+	// SQL. Foreign keys use the renamed tables. Any other references to
+	// a renamed object (e.g. within view or script text) are left as-is
+	// so it's up to the caller to keep them consistent.
+	RenameFunc func(objType Object, schema, name string) (newSchema, newName string)
+
+	// TransformDDL, if set, is called with the generated DDL of each schema,
+	// table, view, script and function (after any RenameFunc) and returns
+	// the DDL to back up instead. (For SCHEMAS the name is "".) The schema
+	// and name are the object's original ones. An error fails the backup.
+	TransformDDL func(objType Object, schema, name, ddl string) (string, error)
+
 	LogLevel string // Defaults to "warning"
 }
 
-func Backup(cfg Conf) error {
+// Metrics receives aggregate measurements of a backup. With
+// ParallelObjectTypes the methods may be called concurrently.
+type Metrics interface {
+	// The time taken to back up an object type
+	ObserveDuration(obj Object, d time.Duration)
+	// The size of each file written
+	AddBytes(n int64)
+	// Backing up an object type failed
+	IncError(obj Object)
+	// The number of objects of a type backed up
+	IncObjects(obj Object, n int)
+}
+
+// DiscoveredObject describes a schema object passed to ObjectFilter
+type DiscoveredObject struct {
+	Type    Object
+	Schema  string
+	Name    string // "" for SCHEMAS
+	Owner   string
+	Rows    float64 // The estimated row count of TABLES
+	RawSize int64   // The estimated raw size in bytes of SCHEMAS and TABLES
+}
+
+// Column describes a table/view column passed to DataQueryTransform
+type Column struct {
+	Name string
+	Type string // e.g. VARCHAR(100) UTF8
+}
+
+type DataSample byte
+
+const (
+	NO_SAMPLE DataSample = iota
+	FIRST_ROWS
+	RANDOM_ROWS
+	SYSTEMATIC_ROWS
+)
+
+type Layout byte
+
+const (
+	FLAT_LAYOUT     Layout = iota // Global objects are at the top level
+	BY_SCOPE_LAYOUT               // Global objects are under global/
+)
+
+type IdentifierQuote byte
+
+const (
+	MIXED_QUOTES IdentifierQuote = iota
+	DOUBLE_QUOTES
+	BRACKET_QUOTES
+)
+
+type NameCase byte
+
+const (
+	PRESERVE_CASE NameCase = iota
+	LOWER_CASE
+	UPPER_CASE
+)
+
+// The resolved plan of a backup passed to OnStart
+type Plan struct {
+	Objects      []Object // The object types to backup (never ALL)
+	Match        string
+	Skip         string // Including the skipped system schemas
+	Destination  string
+	MaxTableRows int
+	MaxViewRows  int
+}
+
+// The outcome of a backup passed to OnFinish
+type Summary struct {
+	FilesWritten int
+	BytesWritten int64
+	Duration     time.Duration
+}
+
+func Backup(cfg Conf) (err error) {
+	b := newBackupRun()
+	// This is registered first so that OnFinish also hears
+	// about backups which fail before they get going.
+	if cfg.OnFinish != nil {
+		b.summary = &Summary{}
+		start := time.Now()
+		defer func() {
+			finishErr := err
+			r := recover()
+			if r != nil {
+				finishErr = fmt.Errorf("Backup panicked: %v", r)
+			}
+			s := *b.summary
+			s.Duration = time.Since(start)
+			cfg.OnFinish(s, finishErr)
+			if r != nil {
+				panic(r)
+			}
+		}()
+	}
 	print("starting logging")
-	err := initLogging(cfg.LogLevel)
+	err = initLogging(cfg.LogLevel)
 	if err != nil {
 		return err
 	}
@@ -85,9 +488,12 @@ func Backup(cfg Conf) error {
 	if cfg.Match == "" {
 		cfg.Match = "*.*"
 	}
-	if cfg.Source == nil {
+	if cfg.Source == nil && cfg.ConnectionFactory == nil {
 		return errors.New("You must specify a source Exasol connection")
 	}
+	if cfg.ParallelObjectTypes && cfg.ConnectionFactory == nil {
+		return errors.New("ParallelObjectTypes requires a ConnectionFactory")
+	}
 	if cfg.Destination == "" {
 		return errors.New("You must specify a Destination")
 	}
@@ -95,86 +501,337 @@ func Backup(cfg Conf) error {
 	if os.IsNotExist(err) || !fi.Mode().IsDir() {
 		return errors.New("The Destination must be a valid directory path")
 	}
+	root := cfg.Destination // OnFileWritten paths are relative to this
+	if cfg.DestinationPrefix != "" {
+		prefix := filepath.Clean(cfg.DestinationPrefix)
+		if filepath.IsAbs(prefix) || prefix == "." || prefix == ".." ||
+			strings.HasPrefix(prefix, ".."+string(filepath.Separator)) {
+			return errors.New("The DestinationPrefix must be a relative path within the Destination")
+		}
+		cfg.Destination = filepath.Join(cfg.Destination, prefix)
+		err = os.MkdirAll(cfg.Destination, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("Unable to create directory %s: %s", cfg.Destination, err)
+		}
+	}
+
+	if cfg.Source == nil {
+		cfg.Source, err = cfg.ConnectionFactory()
+		if err != nil {
+			return fmt.Errorf("Unable to connect to Exasol: %s", err)
+		}
+		defer cfg.Source.Disconnect()
+	}
+
+	var aead cipher.AEAD
+	if cfg.Encrypt != nil {
+		// Fail on a bad key before doing all the work
+		aead, err = cfg.Encrypt.getAEAD()
+		if err != nil {
+			return err
+		}
+	}
+
+	for object, hint := range cfg.DataExportHints {
+		if !dataExportHintRE.MatchString(hint) {
+			return fmt.Errorf("The DataExportHints for %s must only be EXPORT file options", object)
+		}
+		if cfg.DataSink != nil && !parseCSVFormat(hint).isPlainCSV() {
+			return fmt.Errorf("The DataExportHints for %s can't change the CSV format parsed for the DataSink", object)
+		}
+		if cfg.MaxRowsPerFile > 0 && parseCSVFormat(hint).rowSeparator == "NONE" {
+			return fmt.Errorf("The DataExportHints for %s need a ROW SEPARATOR to split the data by", object)
+		}
+	}
+
+	dataEncoding, err := getOutputEncoding(cfg.OutputEncoding, cfg.EncodingErrorMode)
+	if err != nil {
+		return err
+	}
 
 	backup := map[Object]bool{}
 	for _, o := range cfg.Objects {
 		backup[o] = true
 	}
+	if cfg.SchemasOnly {
+		// Schema objects are reduced to just the schemas plus an inventory
+		if backup[ALL] {
+			backup[ALL] = false
+			for _, o := range []Object{CONNECTIONS, PARAMETERS, PRIORITY_GROUPS, ROLES, USERS} {
+				backup[o] = true
+			}
+		}
+		for _, o := range []Object{TABLES, VIEWS, SCRIPTS, FUNCTIONS} {
+			backup[o] = false
+		}
+		backup[SCHEMAS] = true
+	}
+	if cfg.ListOnly {
+		cfg.MaxTableRows = 0
+		cfg.TableRowLimits = nil
+		cfg.MaxViewRows = 0
+		cfg.IncludeInvalidViews = nil
+		cfg.CaptureDistributionStats = false
+	}
+	tableData := cfg.MaxTableRows > 0
+	for _, limit := range cfg.TableRowLimits {
+		if limit != 0 {
+			tableData = true
+		}
+	}
+	b.option = options{
+		ignoreMissingObjects: !cfg.StrictMode && (cfg.IgnoreMissingObjects == nil || *cfg.IgnoreMissingObjects),
+		includeInvalidViews:  cfg.IncludeInvalidViews == nil || *cfg.IncludeInvalidViews,
+		allParameters:        cfg.AllParameters == nil || *cfg.AllParameters,
+		atomicWrites:         cfg.AtomicWrites == nil || *cfg.AtomicWrites,
+		objectTimeout:        cfg.ObjectTimeout,
+		maxRowsPerFile:       cfg.MaxRowsPerFile,
+		tableRowLimits:       cfg.TableRowLimits,
+		strict:               cfg.StrictMode,
+		nameCase:             cfg.NameCase,
+		renameFunc:           cfg.RenameFunc,
+		transformDDL:         cfg.TransformDDL,
+		identifierQuote:      cfg.IdentifierQuote,
+		dataQueryTransform:   cfg.DataQueryTransform,
+		dataSample:           cfg.DataSampleStrategy,
+		nullUnsupportedTypes: cfg.DataExportNullForUnsupportedTypes,
+		tableData:            tableData,
+		noDataColumnTypes:    cfg.NoDataColumnTypes,
+		dataExportHints:      cfg.DataExportHints,
+		encrypt:              aead,
+		outputEncoding:       dataEncoding,
+		dataColumnOrder:      cfg.DataColumnOrder,
+		schemaOrder:          cfg.SchemaOrder,
+		objectFilter:         cfg.ObjectFilter,
+		metrics:              cfg.Metrics,
+		dataColumnOrderOnly:  cfg.DataColumnOrderOnly,
+		dataSink:             cfg.DataSink,
+		writeBufferSize:      cfg.WriteBufferSize,
+		skipEmptyData:        cfg.SkipEmptyTablesData,
+		deferConstraints:     cfg.DeferConstraints,
+		connections:          backup[CONNECTIONS] || backup[ALL],
+		users:                backup[USERS] || backup[ALL],
+		roles:                backup[ROLES] || backup[ALL],
+		dst:                  root,
+		onFileWritten:        cfg.OnFileWritten,
+		groupRemap:           cfg.GroupRemap,
+		dropUnmappedGroups:   cfg.DropUnmappedGroups,
+	}
+	if cfg.FileHeader {
+		b.option.headerHost = cfg.Source.Conf.Host
+		if cfg.FileHeaderTimestamp {
+			b.option.headerTime = time.Now()
+		}
+	}
+	if b.option.writeBufferSize <= 0 {
+		b.option.writeBufferSize = defaultWriteBufferSize
+	}
+	b.progress, err = b.startProgress(cfg.Destination, cfg.Resume)
+	if err != nil {
+		return err
+	}
+	if cfg.EmitSchemaBundle {
+		b.bundles = b.newSchemaBundles()
+	}
+	b.manifest = newBackupManifest()
 	src := cfg.Source
 	dst := cfg.Destination
 	drop := cfg.DropExtras
-	crit := Criteria{cfg.Match, cfg.Skip}
+	globalDst := dst
+	if cfg.Layout == BY_SCOPE_LAYOUT {
+		globalDst = filepath.Join(dst, "global")
+	}
+	crit := getCriteria(cfg)
 
-	// TODO capture and restore original values of these 2 settings
+	// TODO capture and restore the original auto commit setting
 	src.DisableAutoCommit()
-	src.Execute("ALTER SESSION SET NLS_TIMESTAMP_FORMAT='YYYY-MM-DD HH24:MI:SS.FF3'")
+	restoreSession, err := setExportSession(src, cfg.ExportNLS, cfg.ExportTimeZone)
+	if err != nil {
+		return err
+	}
+	defer restoreSession()
 	setCapabilities(src)
 
+	if cfg.OnStart != nil {
+		cfg.OnStart(getPlan(cfg, backup, crit))
+	}
+	if (b.option.tableData && (backup[TABLES] || backup[ALL])) ||
+		(cfg.MaxViewRows > 0 && (backup[VIEWS] || backup[ALL])) {
+		err := b.backupSession(src, dst, cfg.ExportNLS)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.EmitDatabaseInfo {
+		err := b.backupDatabaseInfo(src, dst)
+		if err != nil {
+			return err
+		}
+	}
+	global := &globalRunner{src: src}
+	if cfg.ParallelObjectTypes {
+		global.factory = cfg.ConnectionFactory
+	}
+	defer global.wait()
 	if backup[PARAMETERS] || backup[ALL] {
-		err := BackupParameters(src, dst)
+		err := global.run(func(conn *exasol.Conn) error {
+			return b.measure(PARAMETERS, func() error {
+				return b.backupParameters(conn, globalDst)
+			})
+		})
 		if err != nil {
 			return err
 		}
 	}
-	if backup[PRIORITY_GROUPS] || backup[CONSUMER_GROUPS] || backup[ALL] {
-		if capability.consumerGroups {
-			err = BackupConsumerGroups(src, dst)
-		} else {
-			err = BackupPriorityGroups(src, dst)
+	if !backup[ALL] {
+		unsupported, supported := PRIORITY_GROUPS, CONSUMER_GROUPS
+		msg := "This Exasol version only supports consumer groups"
+		if !capability.consumerGroups {
+			unsupported, supported = CONSUMER_GROUPS, PRIORITY_GROUPS
+			msg = "This Exasol version only supports priority groups"
 		}
+		if backup[unsupported] && !backup[supported] {
+			if cfg.StrictMode {
+				return errors.New(msg)
+			}
+			log.Warning(msg + ", backing them up instead")
+		}
+	}
+	if backup[PRIORITY_GROUPS] || backup[CONSUMER_GROUPS] || backup[ALL] {
+		err = global.run(func(conn *exasol.Conn) error {
+			if capability.consumerGroups {
+				return b.measure(CONSUMER_GROUPS, func() error {
+					return b.backupConsumerGroups(conn, globalDst)
+				})
+			}
+			return b.measure(PRIORITY_GROUPS, func() error {
+				return b.backupPriorityGroups(conn, globalDst)
+			})
+		})
 		if err != nil {
 			return err
 		}
 	}
 	if backup[SCHEMAS] || backup[ALL] {
-		err := BackupSchemas(src, dst, crit, drop)
+		err := b.measure(SCHEMAS, func() error {
+			return b.backupSchemas(src, dst, crit, drop)
+		})
 		if err != nil {
 			return err
 		}
+		if cfg.SchemasOnly {
+			err = b.backupInventory(src, dst, crit)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	if backup[TABLES] || backup[ALL] {
-		err := BackupTables(src, dst, crit, cfg.MaxTableRows, drop)
+		err := b.measure(TABLES, func() error {
+			return b.backupTables(src, dst, crit, cfg.MaxTableRows, cfg.DataWhereByColumn, drop)
+		})
 		if err != nil {
 			return err
 		}
 	}
 	if backup[VIEWS] || backup[ALL] {
-		err := BackupViews(src, dst, crit, cfg.MaxViewRows, drop)
+		err := b.measure(VIEWS, func() error {
+			return b.backupViews(src, dst, crit, cfg.MaxViewRows, cfg.DataWhereByColumn, drop)
+		})
 		if err != nil {
 			return err
 		}
 	}
 	if backup[SCRIPTS] || backup[ALL] {
-		err := BackupScripts(src, dst, crit, drop)
+		err := b.measure(SCRIPTS, func() error {
+			return b.backupScripts(src, dst, crit, drop)
+		})
 		if err != nil {
 			return err
 		}
+		if cfg.AnalyzeImports {
+			err = b.backupExternalDependencies(src, dst, crit)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	if backup[FUNCTIONS] || backup[ALL] {
-		err := BackupFunctions(src, dst, crit, drop)
+		err := b.measure(FUNCTIONS, func() error {
+			return b.backupFunctions(src, dst, crit, drop)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.CaptureDistributionStats && (backup[TABLES] || backup[ALL]) {
+		err := b.backupDistributionStats(src, dst, crit)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.EmitCommentsJSON && (backup[SCHEMAS] || backup[TABLES] ||
+		backup[VIEWS] || backup[SCRIPTS] || backup[FUNCTIONS] || backup[ALL]) {
+		err := b.backupCommentsJSON(src, dst, crit)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[CONNECTIONS] || backup[ALL] {
-		err := BackupConnections(src, dst)
+		err := global.run(func(conn *exasol.Conn) error {
+			return b.measure(CONNECTIONS, func() error {
+				return b.backupConnections(conn, globalDst)
+			})
+		})
 		if err != nil {
 			return err
 		}
 	}
 	if backup[ROLES] || backup[ALL] {
-		err := BackupRoles(src, dst, drop)
+		err := global.run(func(conn *exasol.Conn) error {
+			return b.measure(ROLES, func() error {
+				return b.backupRoles(conn, globalDst, drop)
+			})
+		})
 		if err != nil {
 			return err
 		}
 	}
 	if backup[USERS] || backup[ALL] {
-		err := BackupUsers(src, dst, drop)
+		err := global.run(func(conn *exasol.Conn) error {
+			return b.measure(USERS, func() error {
+				return b.backupUsers(conn, globalDst, drop)
+			})
+		})
 		if err != nil {
 			return err
 		}
+		if cfg.NormalizePrivilegesToRoles {
+			err = global.run(func(conn *exasol.Conn) error {
+				return b.backupRoleSuggestions(conn, globalDst)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = global.wait()
+	if err != nil {
+		return err
+	}
+
+	err = b.bundles.write(dst)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeBackupManifest(dst)
+	if err != nil {
+		return err
 	}
 
+	b.progress.finish()
 	log.Info("Done backing up")
 	return nil
 }
@@ -184,6 +841,9 @@ type Criteria struct {
 	skip  string
 }
 
+// The schemas internal to Exasol which are skipped by default
+var systemSchemas = []string{"SYS", "EXA_STATISTICS"}
+
 /* Private routines */
 
 type dbObj interface {
@@ -196,10 +856,78 @@ type capabilities struct {
 	version        float64
 }
 
+type options struct {
+	ignoreMissingObjects bool
+	includeInvalidViews  bool
+	allParameters        bool
+	atomicWrites         bool
+	objectTimeout        time.Duration
+	maxRowsPerFile       int
+	tableRowLimits       map[string]int
+	strict               bool
+	nameCase             NameCase
+	renameFunc           func(Object, string, string) (string, string)
+	transformDDL         func(Object, string, string, string) (string, error)
+	identifierQuote      IdentifierQuote
+	dataQueryTransform   func(string, string, []Column) (string, bool)
+	dataSample           DataSample
+	nullUnsupportedTypes bool
+	tableData            bool // If any table data is backed up
+	noDataColumnTypes    []string
+	dataExportHints      map[string]string
+	encrypt              cipher.AEAD     // Set if the files are encrypted
+	outputEncoding       *outputEncoding // Set if the data isn't UTF-8
+	dataColumnOrder      map[string][]string
+	dataColumnOrderOnly  bool
+	schemaOrder          []string
+	objectFilter         func(DiscoveredObject) bool
+	metrics              Metrics
+	dataSink             func(string, string, []string, <-chan []string) error
+	writeBufferSize      int
+	skipEmptyData        bool
+	deferConstraints     bool
+	connections          bool // If the connections are being backed up
+	users                bool // If the users are being backed up
+	roles                bool // If the roles are being backed up
+	dst                  string
+	onFileWritten        func(string, int64, string)
+	groupRemap           map[string]string
+	dropUnmappedGroups   bool
+	headerHost           string // Set when FileHeader is enabled
+	headerTime           time.Time
+}
+
+const defaultWriteBufferSize = 1 << 20
+
 var log = logrus.New()
 
 var capability capabilities
 
+var defaultOptions = options{
+	ignoreMissingObjects: true,
+	includeInvalidViews:  true,
+	allParameters:        true,
+	atomicWrites:         true,
+	writeBufferSize:      defaultWriteBufferSize,
+}
+
+// The state of a single Backup call. Each call has its own so that
+// concurrent backups don't share their options, progress, etc.
+type backupRun struct {
+	option        options
+	progress      *backupProgress // Set with Resume
+	bundles       *schemaBundles  // Set with EmitSchemaBundle
+	manifest      *backupManifest // Written to manifest.json
+	summary       *Summary        // Tallied by fileWritten for OnFinish
+	fileWrittenMu sync.Mutex
+}
+
+// Returns a run with the default options, e.g. for the exported
+// Backup* functions when they're called on their own
+func newBackupRun() *backupRun {
+	return &backupRun{option: defaultOptions}
+}
+
 func initLogging(logLevelStr string) error {
 	if logLevelStr == "" {
 		logLevelStr = "warning"
@@ -215,6 +943,79 @@ func initLogging(logLevelStr string) error {
 	return nil
 }
 
+// Times backing up an object type for the Metrics (if any)
+func (b *backupRun) measure(obj Object, backup func() error) error {
+	if b.option.metrics == nil {
+		return backup()
+	}
+	start := time.Now()
+	err := backup()
+	b.option.metrics.ObserveDuration(obj, time.Since(start))
+	if err != nil {
+		b.option.metrics.IncError(obj)
+	}
+	return err
+}
+
+// Counts the objects of a type backed up for the Metrics (if any)
+func (b *backupRun) countObjects(obj Object, n int) {
+	if b.option.metrics != nil && n > 0 {
+		b.option.metrics.IncObjects(obj, n)
+	}
+}
+
+// Whether the ObjectFilter (if any) selects the object
+func (b *backupRun) isSelected(o DiscoveredObject) bool {
+	return b.option.objectFilter == nil || b.option.objectFilter(o)
+}
+
+// Returns the position of the schema in SchemaOrder (or
+// after all of them if it isn't listed) to sort objects by.
+func (b *backupRun) schemaRank(schema string) int {
+	for i, s := range b.option.schemaOrder {
+		if s == schema {
+			return i
+		}
+	}
+	return len(b.option.schemaOrder)
+}
+
+// Resolves the object types which will be backed up
+func getPlan(cfg Conf, backup map[Object]bool, crit Criteria) Plan {
+	plan := Plan{
+		Match:        crit.match,
+		Skip:         crit.skip,
+		Destination:  cfg.Destination,
+		MaxTableRows: cfg.MaxTableRows,
+		MaxViewRows:  cfg.MaxViewRows,
+	}
+	for o := CONNECTIONS; o <= VIEWS; o++ {
+		if o == PRIORITY_GROUPS || o == CONSUMER_GROUPS {
+			// Only the type this Exasol version supports is backed up
+			groups := backup[ALL] || backup[PRIORITY_GROUPS] || backup[CONSUMER_GROUPS]
+			if !groups || (o == CONSUMER_GROUPS) != capability.consumerGroups {
+				continue
+			}
+		} else if !backup[o] && !backup[ALL] {
+			continue
+		}
+		plan.Objects = append(plan.Objects, o)
+	}
+	return plan
+}
+
+func getCriteria(cfg Conf) Criteria {
+	crit := Criteria{cfg.Match, cfg.Skip}
+	if !cfg.IncludeSystemObjects {
+		skip := systemSchemas
+		if crit.skip != "" {
+			skip = append([]string{crit.skip}, systemSchemas...)
+		}
+		crit.skip = strings.Join(skip, ",")
+	}
+	return crit
+}
+
 func (c *Criteria) getSQLCriteria() string {
 	whereClause := buildCriteria(c.match)
 	if c.skip != "" {
@@ -289,8 +1090,369 @@ func buildCriteria(argStr string) string {
 	return strings.Join(whereClause, " OR ")
 }
 
-func removeExtraObjects(objType string, srcObjs []dbObj, dst string, crit Criteria) {
-	log.Infof("Removing extraneous %s", objType)
+// Returns the DataQueryTransform select list for an object or the
+// getDataColumnList (and its warnings) if there's none.
+func (b *backupRun) getDataSelectList(schema, object string, cols []Column) (string, []string, error) {
+	if b.option.dataQueryTransform != nil {
+		selectList, ok := b.option.dataQueryTransform(schema, object, cols)
+		if ok {
+			return selectList, nil, nil
+		}
+	}
+	return b.getDataColumnList(schema, object, cols)
+}
+
+// Returns the select list of the columns to back up the data of
+// with any NoDataColumnTypes columns replaced by NULL. So are columns
+// of unsupported types with DataExportNullForUnsupportedTypes and
+// the warnings about them are returned.
+func (b *backupRun) getDataColumnList(schema, object string, cols []Column) (string, []string, error) {
+	var list []string
+	var warnings []string
+COL:
+	for _, col := range cols {
+		colType := strings.ToUpper(col.Type)
+		for _, t := range b.option.noDataColumnTypes {
+			t = strings.ToUpper(t)
+			if colType == t || strings.HasPrefix(colType, t+"(") || strings.HasPrefix(colType, t+" ") {
+				list = append(list, "NULL AS "+bracket(col.Name))
+				continue COL
+			}
+		}
+		if b.option.nullUnsupportedTypes && !isSupportedColumnType(colType) {
+			if b.option.strict {
+				return "", nil, fmt.Errorf(
+					"Unable to back up the data of %s.%s: column %s has the unsupported type %s",
+					schema, object, col.Name, col.Type,
+				)
+			}
+			msg := fmt.Sprintf("Column %s of unsupported type %s was backed up as NULL", col.Name, col.Type)
+			log.Warningf("%s.%s: %s", schema, object, msg)
+			warnings = append(warnings, msg)
+			list = append(list, "NULL AS "+bracket(col.Name))
+			continue
+		}
+		list = append(list, bracket(col.Name))
+	}
+	return strings.Join(list, ","), warnings, nil
+}
+
+// The data types Exasol's CSV export is known to represent faithfully
+var supportedColumnTypes = []string{
+	"BOOLEAN", "CHAR", "VARCHAR", "DECIMAL", "DOUBLE", "DATE",
+	"TIMESTAMP", "INTERVAL", "GEOMETRY", "HASHTYPE",
+}
+
+func isSupportedColumnType(colType string) bool {
+	// e.g. VARCHAR(100) UTF8 or INTERVAL DAY(2) TO SECOND(3)
+	baseType := strings.ToUpper(colType)
+	if i := strings.IndexAny(baseType, "( "); i >= 0 {
+		baseType = baseType[:i]
+	}
+	for _, t := range supportedColumnTypes {
+		if baseType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// An EXPORT file option a DataExportHints clause can be made up of. Their
+// values can't contain a quote so they can't break out of the literal.
+// ENCODING isn't one since the data files' encoding is the OutputEncoding.
+const dataExportOption = `(?:(NULL|BOOLEAN|ROW\s+SEPARATOR|COLUMN\s+SEPARATOR|COLUMN\s+DELIMITER)\s*=\s*'([^']*)'` +
+	`|(DELIMIT)\s*=\s*(ALWAYS|NEVER|AUTO)` +
+	`|(WITH\s+COLUMN\s+NAMES))`
+
+var dataExportHintRE = regexp.MustCompile(
+	`(?i)^\s*` + dataExportOption + `(?:\s+` + dataExportOption + `)*\s*$`,
+)
+
+var dataExportOptionRE = regexp.MustCompile(`(?i)` + dataExportOption)
+
+// The CSV format of an object's data which its DataExportHints can change
+type csvFormat struct {
+	rowSeparator    string // LF, CR, CRLF or NONE
+	columnSeparator string
+	columnDelimiter string
+	delimit         string // AUTO, ALWAYS or NEVER
+	columnNames     bool   // If the first row is the column names
+}
+
+// Returns the CSV format of the data exported with the given DataExportHints
+func parseCSVFormat(hint string) csvFormat {
+	f := csvFormat{rowSeparator: "LF", columnSeparator: ",", columnDelimiter: `"`, delimit: "AUTO"}
+	for _, m := range dataExportOptionRE.FindAllStringSubmatch(hint, -1) {
+		name := strings.ToUpper(strings.Join(strings.Fields(m[1]+m[3]+m[5]), " "))
+		value := m[2] + m[4]
+		switch name {
+		case "ROW SEPARATOR":
+			f.rowSeparator = strings.ToUpper(value)
+		case "COLUMN SEPARATOR":
+			f.columnSeparator = value
+		case "COLUMN DELIMITER":
+			f.columnDelimiter = value
+		case "DELIMIT":
+			f.delimit = strings.ToUpper(value)
+		case "WITH COLUMN NAMES":
+			f.columnNames = true
+		}
+	}
+	return f
+}
+
+func (b *backupRun) getCSVFormat(schema, object string) csvFormat {
+	return parseCSVFormat(b.option.dataExportHints[schema+"."+object])
+}
+
+// Returns if the data can be parsed as plain CSV (as it is for a DataSink)
+func (f csvFormat) isPlainCSV() bool {
+	return f.rowSeparator == "LF" && f.columnSeparator == "," &&
+		f.columnDelimiter == `"` && !f.columnNames
+}
+
+// Returns the DataExportHints clauses (if any) to append to an object's
+// EXPORT. The data's always exported as UTF-8 and transcoded as it's
+// written so that unrepresentable characters follow the EncodingErrorMode.
+func (b *backupRun) getDataExportHint(schema, object string) string {
+	var opts string
+	hint, ok := b.option.dataExportHints[schema+"."+object]
+	if ok && hint != "" {
+		opts = " " + hint
+	}
+	// The export SQL is a format string
+	return strings.Replace(opts, "%", "%%", -1)
+}
+
+// The suffix of the temporary files written with AtomicWrites
+const tmpExt = ".tmp"
+
+// Writes a file. With AtomicWrites it's written to a temporary file
+// which is then renamed into place. With Encrypt it's written encrypted
+// to the <file>.enc (replacing any plaintext file from a prior backup).
+func (b *backupRun) writeFile(file string, data []byte) error {
+	if b.option.encrypt == nil {
+		return b.writeRawFile(file, data)
+	}
+	data, err := encrypt(b.option.encrypt, data)
+	if err != nil {
+		return err
+	}
+	err = b.writeRawFile(b.storedPath(file), data)
+	if err != nil {
+		return err
+	}
+	os.Remove(file)
+	return nil
+}
+
+func (b *backupRun) writeRawFile(file string, data []byte) error {
+	if !b.option.atomicWrites {
+		return ioutil.WriteFile(file, data, 0644)
+	}
+	err := ioutil.WriteFile(file+tmpExt, data, 0644)
+	if err != nil {
+		os.Remove(file + tmpExt)
+		return err
+	}
+	return os.Rename(file+tmpExt, file)
+}
+
+// Calls the OnFileWritten hook (if any) for a completely written file
+func (b *backupRun) fileWritten(fp string) {
+	b.fileStored(b.storedPath(fp))
+}
+
+// Like fileWritten but for the path the file is actually stored at
+func (b *backupRun) fileStored(fp string) {
+	if b.option.onFileWritten == nil && b.summary == nil && b.option.metrics == nil {
+		return
+	}
+	fi, err := os.Stat(fp)
+	if err != nil {
+		log.Warningf("Unable to stat file %s: %s", fp, err)
+		return
+	}
+	if b.option.metrics != nil {
+		b.option.metrics.AddBytes(fi.Size())
+	}
+	if b.summary != nil {
+		b.fileWrittenMu.Lock()
+		b.summary.FilesWritten++
+		b.summary.BytesWritten += fi.Size()
+		b.fileWrittenMu.Unlock()
+	}
+	if b.option.onFileWritten == nil {
+		return
+	}
+	relPath, err := filepath.Rel(b.option.dst, fp)
+	if err != nil {
+		log.Warning(err)
+		return
+	}
+	sum, err := fileChecksum(fp)
+	if err != nil {
+		log.Warning(err)
+		return
+	}
+	b.fileWrittenMu.Lock()
+	defer b.fileWrittenMu.Unlock()
+	b.option.onFileWritten(filepath.ToSlash(relPath), fi.Size(), sum)
+}
+
+// Returns the comment banner to start the object's .sql file with
+// or "" if FileHeader isn't enabled.
+func (b *backupRun) fileHeader(object string) string {
+	if b.option.headerHost == "" {
+		return ""
+	}
+	var at string
+	if !b.option.headerTime.IsZero() {
+		at = " at " + b.option.headerTime.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf(
+		"-- Generated by go-exasol-backup from %s%s for %s\n",
+		b.option.headerHost, at, object,
+	)
+}
+
+// Returns the consumer/priority group a user/role should reference
+// according to GroupRemap or "" if the reference should be dropped.
+func (b *backupRun) remapGroup(group string) string {
+	if newGroup, ok := b.option.groupRemap[group]; ok {
+		return newGroup
+	}
+	if b.option.dropUnmappedGroups {
+		return ""
+	}
+	return group
+}
+
+// This runs the backup of each database-global object type either right
+// away on the source connection or, with ParallelObjectTypes, on its own
+// connection concurrently with the rest of the backup. They write to
+// disjoint files so they need no coordination.
+type globalRunner struct {
+	src     *exasol.Conn
+	factory func() (*exasol.Conn, error) // Set if running in parallel
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+	panic   interface{}
+}
+
+func (g *globalRunner) run(backup func(*exasol.Conn) error) error {
+	if g.factory == nil {
+		return backup(g.src)
+	}
+	conn, err := g.factory()
+	if err != nil {
+		return fmt.Errorf("Unable to connect to Exasol: %s", err)
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer conn.Disconnect()
+		defer func() {
+			// Hand the panic to the Backup goroutine rather
+			// than letting it take down the whole process.
+			r := recover()
+			if r != nil {
+				g.mu.Lock()
+				if g.panic == nil {
+					g.panic = r
+				}
+				g.mu.Unlock()
+			}
+		}()
+		err := backup(conn)
+		g.mu.Lock()
+		if err != nil && g.err == nil {
+			g.err = err
+		}
+		g.mu.Unlock()
+	}()
+	return nil
+}
+
+// Returns the first error of the object types run in parallel.
+// If any of them panicked then this re-panics with it.
+func (g *globalRunner) wait() error {
+	g.wg.Wait()
+	g.mu.Lock()
+	r := g.panic
+	g.panic = nil
+	g.mu.Unlock()
+	if r != nil {
+		panic(r)
+	}
+	return g.err
+}
+
+// Applies TransformDDL to an object's generated DDL
+func (b *backupRun) transformDDL(objType Object, schema, name, ddl string) (string, error) {
+	if b.option.transformDDL == nil {
+		return ddl, nil
+	}
+	newDDL, err := b.option.transformDDL(objType, schema, name, ddl)
+	if err != nil {
+		return "", fmt.Errorf("Unable to transform DDL of %s.%s: %s", schema, name, err)
+	}
+	return newDDL, nil
+}
+
+var queryTimeoutRE = regexp.MustCompile(`(?i)timeout was reached`)
+
+// Whether a data query failed because it ran into ObjectTimeout
+func (b *backupRun) isTimeoutError(err error) bool {
+	return b.option.objectTimeout > 0 && err != nil && queryTimeoutRE.MatchString(err.Error())
+}
+
+// Streams the results of a data EXPORT. It's a var so that tests can
+// mock out slow or failing exports.
+var streamQuery = func(conn *exasol.Conn, exportSQL string) *exasol.Rows {
+	return conn.StreamQuery(exportSQL)
+}
+
+// Returns the schema and name an object is backed up as according to RenameFunc
+func (b *backupRun) renamed(objType Object, schema, name string) (string, string) {
+	if b.option.renameFunc == nil {
+		return schema, name
+	}
+	return b.option.renameFunc(objType, schema, name)
+}
+
+// Returns a WHERE clause made up of the DataWhereByColumn predicates
+// for whichever of the columns an object has, or "" if none apply.
+func getDataWhereClause(dataWhere map[string]string, colNames []string) string {
+	var predicates []string
+	for _, colName := range colNames {
+		for col, predicate := range dataWhere {
+			if strings.EqualFold(col, colName) {
+				predicates = append(predicates, "("+predicate+")")
+			}
+		}
+	}
+	if len(predicates) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(predicates, " AND ")
+}
+
+// The suffix of the data files split by MaxRowsPerFile
+var dataChunkRE = regexp.MustCompile(`\.\d{3,}$`)
+
+var objectDirs = map[Object]string{
+	SCHEMAS:   "schemas",
+	TABLES:    "tables",
+	VIEWS:     "views",
+	SCRIPTS:   "scripts",
+	FUNCTIONS: "functions",
+}
+
+func (b *backupRun) removeExtraObjects(objType Object, srcObjs []dbObj, dst string, crit Criteria) {
+	dirName := objectDirs[objType]
+	log.Infof("Removing extraneous %s", dirName)
 
 	schemaDir := filepath.Join(dst, "schemas")
 	os.MkdirAll(schemaDir, os.ModePerm) // May be the first time we're backing up the env
@@ -306,18 +1468,19 @@ func removeExtraObjects(objType string, srcObjs []dbObj, dst string, crit Criter
 SCHEMA:
 	for _, dstSchema := range dstSchemas {
 		if dstSchema.IsDir() && crit.matches(dstSchema.Name(), "") {
-			if objType == "schemas" {
+			if objType == SCHEMAS {
 				for _, srcObj := range srcObjs {
 					// Check if existing destination schema still exists
 					// in the source. If not we'll remove it
-					if srcObj.Schema() == dstSchema.Name() {
+					srcSchema, _ := b.renamed(objType, srcObj.Schema(), srcObj.Name())
+					if b.fileName(srcSchema) == dstSchema.Name() {
 						continue SCHEMA
 					}
 				}
 				os.RemoveAll(filepath.Join(schemaDir, dstSchema.Name()))
 
 			} else { // Non-Schema objects
-				objDir := filepath.Join(schemaDir, dstSchema.Name(), objType)
+				objDir := filepath.Join(schemaDir, dstSchema.Name(), dirName)
 				objs, err := ioutil.ReadDir(objDir)
 				if err != nil {
 					// No objects in this schema
@@ -325,17 +1488,20 @@ SCHEMA:
 				}
 			OBJ:
 				for _, obj := range objs {
-					objBaseName := strings.TrimSuffix(obj.Name(), filepath.Ext(obj.Name()))
+					objBaseName := strings.TrimSuffix(obj.Name(), encryptedExt)
+					objBaseName = strings.TrimSuffix(objBaseName, filepath.Ext(objBaseName))
+					objBaseName = dataChunkRE.ReplaceAllString(objBaseName, "")
 					if crit.matches(dstSchema.Name(), objBaseName) {
 						for _, srcObj := range srcObjs {
 							// Check if existing destination object still exists
 							// in the source. If not we'll remove it
-							if dstSchema.Name() == srcObj.Schema() &&
-								objBaseName == srcObj.Name() {
+							srcSchema, srcName := b.renamed(objType, srcObj.Schema(), srcObj.Name())
+							if dstSchema.Name() == b.fileName(srcSchema) &&
+								objBaseName == b.fileName(srcName) {
 								continue OBJ
 							}
 						}
-						log.Infof("Dropping %s.%s %s", dstSchema.Name(), objBaseName, objType)
+						log.Infof("Dropping %s.%s %s", dstSchema.Name(), objBaseName, dirName)
 						os.Remove(filepath.Join(objDir, obj.Name()))
 					}
 				}
@@ -344,6 +1510,80 @@ SCHEMA:
 	}
 }
 
+// This is used when reading an object fails to check whether
+// it's because the object has been dropped since it was listed.
+func (b *backupRun) isMissingObject(conn *exasol.Conn, schema, object string) bool {
+	if !b.option.ignoreMissingObjects {
+		return false
+	}
+	sql := fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM exa_all_objects
+		WHERE root_type = 'SCHEMA'
+		  AND root_name = '%s'
+		  AND object_name = '%s'
+		`, qStr(schema), qStr(object),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		log.Warning(err)
+		return false
+	}
+	return res[0][0].(float64) == 0
+}
+
+// Quotes an identifier which by default is quoted as [...]
+func (b *backupRun) qb(name string) string {
+	if b.option.identifierQuote == DOUBLE_QUOTES {
+		return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+	}
+	return bracket(name)
+}
+
+// Quotes an identifier which by default is quoted as "..."
+func (b *backupRun) qd(name string) string {
+	if b.option.identifierQuote == BRACKET_QUOTES {
+		return bracket(name)
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Quotes an identifier as [...] regardless of IdentifierQuote
+// e.g. for the queries run against the source
+func bracket(name string) string {
+	return "[" + strings.Replace(name, "]", "]]", -1) + "]"
+}
+
+// Quotes and comma-delimits a list of identifiers via qd
+func (b *backupRun) qdList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = b.qd(name)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// Quotes and comma-delimits a list of identifiers via bracket
+func bracketList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = bracket(name)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// Returns the file/directory name to use for an object name
+func (b *backupRun) fileName(name string) string {
+	switch b.option.nameCase {
+	case LOWER_CASE:
+		return strings.ToLower(name)
+	case UPPER_CASE:
+		return strings.ToUpper(name)
+	default:
+		return name
+	}
+}
+
 func qStr(str string) string {
 	return exasol.QuoteStr(str)
 }
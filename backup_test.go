@@ -13,6 +13,8 @@ package backup
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -20,6 +22,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -106,6 +109,14 @@ func (s *testSuite) backup(cnf Conf, args ...Object) {
 
 type dt map[string]interface{} // Directory/file Tree
 
+// The default export session settings backed up alongside any data
+var testSessionSQL = `
+	ALTER SESSION SET NLS_DATE_FORMAT='YYYY-MM-DD';
+	ALTER SESSION SET NLS_NUMERIC_CHARACTERS='.,';
+	ALTER SESSION SET NLS_TIMESTAMP_FORMAT='YYYY-MM-DD HH24:MI:SS.FF3';
+	ALTER SESSION SET TIME_ZONE='EUROPE/BERLIN';
+`
+
 func (s *testSuite) expect(expected dt) {
 	s.expectDir(s.testDir, expected)
 }
@@ -188,6 +199,71 @@ func (s *testSuite) TestParameters() {
 	})
 }
 
+func (s *testSuite) TestNonDefaultParameters() {
+	allParameters := false
+	s.backup(Conf{AllParameters: &allParameters}, PARAMETERS)
+	s.expect(dt{
+		"parameters.sql": `
+            ALTER SYSTEM SET SCRIPT_LANGUAGES='R=builtin_r JAVA=builtin_java PYTHON3=builtin_python3';
+            ALTER SYSTEM SET TIME_ZONE='EUROPE/BERLIN';
+        `,
+	})
+	nonDefault, err := ioutil.ReadFile(filepath.Join(s.testDir, "parameters.sql"))
+	s.NoError(err)
+
+	allParameters = true
+	s.backup(Conf{AllParameters: &allParameters}, PARAMETERS)
+	all, err := ioutil.ReadFile(filepath.Join(s.testDir, "parameters.sql"))
+	s.NoError(err)
+	s.Greater(strings.Count(string(all), "\n"), strings.Count(string(nonDefault), "\n"))
+
+	// The installation's own settings never count as defaults
+	for _, defaults := range parameterDefaults {
+		s.NotContains(defaults, "TIME_ZONE")
+		s.NotContains(defaults, "SCRIPT_LANGUAGES")
+	}
+	s.Equal("OFF", parameterDefaults[7]["SNAPSHOT_MODE"])
+}
+
+func (s *testSuite) TestDatabaseInfo() {
+	s.backup(Conf{EmitDatabaseInfo: true})
+	data, err := ioutil.ReadFile(filepath.Join(s.testDir, "database_info.json"))
+	s.NoError(err)
+	info := &databaseInfo{}
+	s.NoError(json.Unmarshal(data, info))
+	s.NotEmpty(info.Metadata["databaseProductName"])
+	s.Regexp(`^\d+\.\d+`, info.Metadata["databaseProductVersion"])
+	s.Contains(info.ScriptLanguages, "PYTHON3=")
+}
+
+func (s *testSuite) TestDistributionStats() {
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0), DISTRIBUTE BY A)`,
+		`CREATE OR REPLACE TABLE [test].T2 (A DECIMAL(18,0))`,
+		`INSERT INTO [test].T1 VALUES 1, 2, 3`,
+		`INSERT INTO [test].T2 VALUES 1, 2, 3`,
+	)
+	s.backup(Conf{CaptureDistributionStats: true}, TABLES)
+	data, err := ioutil.ReadFile(filepath.Join(s.testDir, "distribution_stats.json"))
+	s.NoError(err)
+	var stats []*distributionStats
+	s.NoError(json.Unmarshal(data, &stats))
+	// Only the table with a distribution key
+	s.Len(stats, 1)
+	s.Equal("T1", stats[0].Table)
+	s.NotEmpty(stats[0].RowsPerNode)
+	var total int64
+	for _, rows := range stats[0].RowsPerNode {
+		total += rows
+	}
+	s.Equal(int64(3), total)
+	s.GreaterOrEqual(stats[0].Skew, 1.0)
+
+	os.Remove(filepath.Join(s.testDir, "distribution_stats.json"))
+	s.backup(Conf{CaptureDistributionStats: true, ListOnly: true}, TABLES)
+	s.NoFileExists(filepath.Join(s.testDir, "distribution_stats.json"))
+}
+
 func (s *testSuite) TestSchemas() {
 	adapterSQL := `
 CREATE PYTHON3 ADAPTER SCRIPT [test].vs_adapter AS
@@ -237,21 +313,390 @@ def adapter_call(js):
 	s.execute("DROP ADAPTER SCRIPT [test].vs_adapter")
 }
 
+func (s *testSuite) TestSchemaSizeLimit() {
+	sizeSQL := "ALTER SCHEMA [test2] SET RAW_SIZE_LIMIT = 1000000000;\n"
+	s.execute(
+		"CREATE SCHEMA [test2]", sizeSQL,
+		// Reset to the default (no limit)
+		"ALTER SCHEMA [test] SET RAW_SIZE_LIMIT = 1234567890",
+		"ALTER SCHEMA [test] SET RAW_SIZE_LIMIT = 0",
+	)
+	s.backup(Conf{}, SCHEMAS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": s.schemaSQL,
+			},
+			"test2": dt{
+				"schema.sql": "CREATE SCHEMA IF NOT EXISTS [test2];\n" + sizeSQL,
+			},
+		},
+	})
+
+	s.execute("DROP SCHEMA [test2] CASCADE")
+}
+
+func (s *testSuite) TestObjectFilter() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(table1SQL, table2SQL,
+		`INSERT INTO [test].T1 VALUES 1, 2, 3`,
+		`INSERT INTO [test].T2 VALUES 1`,
+	)
+	var discovered []DiscoveredObject
+	bigTables := func(o DiscoveredObject) bool {
+		discovered = append(discovered, o)
+		return o.Rows >= 2
+	}
+	s.backup(Conf{MaxTableRows: 100, ObjectFilter: bigTables}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T1.csv": "1\n2\n3\n",
+				},
+			},
+		},
+	})
+	s.Len(discovered, 2)
+	s.Equal(TABLES, discovered[0].Type)
+	s.Equal("test", discovered[0].Schema)
+	s.Equal("T1", discovered[0].Name)
+	s.Equal("SYS", discovered[0].Owner)
+
+	// DropExtras leaves the files of the skipped tables alone
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.backup(Conf{MaxTableRows: 100, ObjectFilter: bigTables, DropExtras: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T1.csv": "1\n2\n3\n",
+					"T2.sql": table2SQL,
+					"T2.csv": "1\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestSchemaOrder() {
+	s.execute(
+		"CREATE SCHEMA [test2]",
+		"CREATE OR REPLACE TABLE [test2].T1 (A DECIMAL(18,0))",
+		"CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0))",
+	)
+	var written []string
+	s.backup(Conf{
+		SchemaOrder: []string{"test2"},
+		OnFileWritten: func(relPath string, size int64, checksum string) {
+			written = append(written, relPath)
+		},
+	}, SCHEMAS, TABLES)
+	s.Equal([]string{
+		"schemas/test2/schema.sql",
+		"schemas/test/schema.sql",
+		"schemas/test2/tables/T1.sql",
+		"schemas/test/tables/T1.sql",
+	}, written)
+
+	s.execute("DROP SCHEMA [test2] CASCADE")
+}
+
+func (s *testSuite) TestDestinationPrefix() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL)
+	var written []string
+	onFileWritten := func(relPath string, size int64, checksum string) {
+		written = append(written, relPath)
+	}
+	s.backup(Conf{DestinationPrefix: "db1", OnFileWritten: onFileWritten}, TABLES)
+	s.backup(Conf{DestinationPrefix: "db2"}, TABLES)
+	s.Equal([]string{"db1/schemas/test/tables/T1.sql"}, written)
+
+	// DropExtras under one prefix doesn't touch the other's files
+	s.execute("DROP TABLE [test].T1")
+	s.backup(Conf{DestinationPrefix: "db1", DropExtras: true}, TABLES)
+	s.expect(dt{
+		"db1": dt{
+			"schemas": dt{
+				"test": dt{
+					"tables": dt{},
+				},
+			},
+		},
+		"db2": dt{
+			"schemas": dt{
+				"test": dt{
+					"tables": dt{
+						"T1.sql": tableSQL,
+					},
+				},
+			},
+		},
+	})
+
+	err := Backup(Conf{
+		Source:            s.exaConn,
+		Destination:       s.testDir,
+		DestinationPrefix: "../elsewhere",
+		LogLevel:          s.loglevel,
+		Objects:           []Object{TABLES},
+	})
+	s.Error(err)
+}
+
+func (s *testSuite) TestConnectionFactory() {
+	// The factory's connection is a separate session
+	// so the test schema has to be visible to it.
+	s.exaConn.Commit()
+	var conn *exasol.Conn
+	factory := func() (*exasol.Conn, error) {
+		var err error
+		conn, err = exasol.Connect(exasol.ConnConf{
+			Host:      *testHost,
+			Port:      uint16(*testPort),
+			Username:  "SYS",
+			Password:  *testPass,
+			Logger:    log,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+		return conn, err
+	}
+	err := Backup(Conf{
+		ConnectionFactory: factory,
+		Destination:       s.testDir,
+		LogLevel:          s.loglevel,
+		Objects:           []Object{SCHEMAS},
+	})
+	s.NoError(err)
+	s.NotNil(conn)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": s.schemaSQL,
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestParallelObjectTypes() {
+	// The factory's connections are separate sessions
+	// so the test schema has to be visible to them.
+	s.exaConn.Commit()
+	factory := func() (*exasol.Conn, error) {
+		return exasol.Connect(exasol.ConnConf{
+			Host:      *testHost,
+			Port:      uint16(*testPort),
+			Username:  "SYS",
+			Password:  *testPass,
+			Logger:    log,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+	}
+	readTree := func(dir string) map[string]string {
+		tree := map[string]string{}
+		filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+			s.NoError(err)
+			if !info.IsDir() {
+				data, err := ioutil.ReadFile(fp)
+				s.NoError(err)
+				rel, _ := filepath.Rel(dir, fp)
+				tree[rel] = string(data)
+			}
+			return nil
+		})
+		return tree
+	}
+
+	s.backup(Conf{}, ALL)
+	serial := readTree(s.testDir)
+
+	parallelDir, err := ioutil.TempDir("", "exasol-backup-parallel")
+	s.NoError(err)
+	defer os.RemoveAll(parallelDir)
+	err = Backup(Conf{
+		Source:              s.exaConn,
+		ConnectionFactory:   factory,
+		ParallelObjectTypes: true,
+		Destination:         parallelDir,
+		LogLevel:            s.loglevel,
+		Objects:             []Object{ALL},
+	})
+	s.NoError(err)
+	s.Equal(serial, readTree(parallelDir))
+
+	s.Error(Backup(Conf{
+		Source:              s.exaConn,
+		ParallelObjectTypes: true,
+		Destination:         parallelDir,
+		LogLevel:            s.loglevel,
+		Objects:             []Object{ALL},
+	}))
+}
+
+func (s *testSuite) TestConcurrentBackups() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES 1, 2`)
+	// Each backup gets its own session from the factory
+	// so the test schema has to be visible to them.
+	s.exaConn.Commit()
+	factory := func() (*exasol.Conn, error) {
+		return exasol.Connect(exasol.ConnConf{
+			Host:      *testHost,
+			Port:      uint16(*testPort),
+			Username:  "SYS",
+			Password:  *testPass,
+			Logger:    log,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+	}
+	lowerDir, err := ioutil.TempDir(s.tmpDir, "exasol-test-data-")
+	s.NoError(err)
+	defer os.RemoveAll(lowerDir)
+
+	// Neither backup picks up the other's options
+	wg := &sync.WaitGroup{}
+	errs := make([]error, 2)
+	for i, cnf := range []Conf{
+		{Destination: s.testDir, MaxTableRows: 100},
+		{Destination: lowerDir, NameCase: LOWER_CASE},
+	} {
+		wg.Add(1)
+		go func(i int, cnf Conf) {
+			defer wg.Done()
+			cnf.ConnectionFactory = factory
+			cnf.LogLevel = s.loglevel
+			cnf.Objects = []Object{TABLES}
+			errs[i] = Backup(cnf)
+		}(i, cnf)
+	}
+	wg.Wait()
+	s.NoError(errs[0])
+	s.NoError(errs[1])
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1\n2\n",
+				},
+			},
+		},
+	})
+	s.expectDir(lowerDir, dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"t1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestListOnly() {
+	openSchemaSQL := "OPEN SCHEMA [test];\n"
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	// Querying this view's data would take far too long
+	viewSQL := `CREATE OR REPLACE FORCE VIEW "test"."V1" AS
+		SELECT COUNT(*) AS c
+		FROM VALUES BETWEEN 1 AND 1000000 AS a(i),
+			 VALUES BETWEEN 1 AND 1000000 AS b(i)`
+	s.execute(openSchemaSQL, tableSQL, `INSERT INTO T1 VALUES 1, 2`, viewSQL)
+	includeInvalid := false
+	s.backup(Conf{
+		ListOnly:            true,
+		MaxTableRows:        100,
+		MaxViewRows:         100,
+		IncludeInvalidViews: &includeInvalid,
+	}, TABLES, VIEWS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+				"views": dt{
+					"V1.sql": openSchemaSQL + viewSQL + ";\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestSchemasOnly() {
+	tableSQL := `CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0))`
+	dataSQL := `INSERT INTO [test].T1 VALUES 1, 2`
+	s.execute(tableSQL, dataSQL)
+	s.backup(Conf{SchemasOnly: true, MaxTableRows: 100}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": s.schemaSQL,
+			},
+		},
+		"inventory.json": `{
+			"schemas": [
+				{
+					"name": "test",
+					"counts": {
+						"TABLE": 1
+					},
+					"objects": [
+						{
+							"name": "T1",
+							"type": "TABLE",
+							"rows": 2
+						}
+					]
+				}
+			]
+		}
+		`,
+	})
+}
+
 func (s *testSuite) TestTables() {
 	table1SQL := `
 		CREATE OR REPLACE TABLE "test"."T1" (
 			"A" DECIMAL(18,0),
 			"B" DECIMAL(18,0),
-			PRIMARY KEY ("A","B")
+			PRIMARY KEY ("A","B") ENABLE
 		);
 	`
 	table2SQL := `
 		CREATE OR REPLACE TABLE "test"."T2" (
-			"A" DECIMAL(18,0) IDENTITY 321 NOT NULL COMMENT IS 'column A comment',
+			"A" DECIMAL(18,0) IDENTITY 321 NOT NULL ENABLE COMMENT IS 'column A comment',
 			"B" DECIMAL(18,0) COMMENT IS 'column B comment',
 			"C" DECIMAL(18,0) DEFAULT 123 CONSTRAINT "cnst" NOT NULL DISABLE,
 			FOREIGN KEY ("B","C") REFERENCES "test"."T1" ("A","B") DISABLE,
-			CONSTRAINT "mypk" PRIMARY KEY ("A","C"),
+			CONSTRAINT "mypk" PRIMARY KEY ("A","C") ENABLE,
 			DISTRIBUTE BY "A","B",
 			PARTITION BY "B","C"
 		) COMMENT IS 'table comment';
@@ -274,6 +719,7 @@ func (s *testSuite) TestTables() {
 	// Test --max-table-rows
 	s.backup(Conf{MaxTableRows: 100}, TABLES)
 	s.expect(dt{
+		"session.sql": testSessionSQL,
 		"schemas": dt{
 			"test": dt{
 				"tables": dt{
@@ -290,6 +736,7 @@ func (s *testSuite) TestTables() {
 	s.execute("DROP TABLE t2")
 	s.backup(Conf{DropExtras: true}, TABLES)
 	s.expect(dt{
+		"session.sql": testSessionSQL,
 		"schemas": dt{
 			"test": dt{
 				"tables": dt{
@@ -301,68 +748,2147 @@ func (s *testSuite) TestTables() {
 	})
 }
 
-func (s *testSuite) TestViews() {
-	openSchemaSQL := "OPEN SCHEMA [test];\n"
-	view1SQL := `CREATE OR REPLACE FORCE VIEW "test"."V1"
-		  (c COMMENT IS 'column comment') AS
-			SELECT 'Hi Mom!!' AS col
-		  COMMENT IS 'view comment'`
-	view2SQL := `CREATE OR REPLACE FORCE VIEW "test"."V2" AS SELECT 1 c`
-	s.execute(openSchemaSQL, view1SQL, view2SQL)
-	s.backup(Conf{MaxViewRows: 0}, VIEWS)
+func (s *testSuite) TestCommentOrder() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"C" DECIMAL(18,0) COMMENT IS 'column C comment',
+			"A" DECIMAL(18,0) COMMENT IS 'column A comment',
+			"B" DECIMAL(18,0) COMMENT IS 'column B comment'
+		) COMMENT IS 'table comment';
+	`
+	s.execute(tableSQL)
+	fp := filepath.Join(s.testDir, "schemas", "test", "tables", "T1.sql")
+	var first []byte
+	for i := 0; i < 3; i++ {
+		s.backup(Conf{}, TABLES)
+		got, err := ioutil.ReadFile(fp)
+		s.NoError(err)
+		if i == 0 {
+			first = got
+		}
+		s.Equal(string(first), string(got))
+	}
 	s.expect(dt{
 		"schemas": dt{
 			"test": dt{
-				"views": dt{
-					"V1.sql": openSchemaSQL + view1SQL + ";\n",
-					"V2.sql": openSchemaSQL + view2SQL + ";\n",
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestColumnDefaultNotNullComment() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" VARCHAR(10) UTF8 DEFAULT 'x,y' NOT NULL ENABLE COMMENT IS 'it''s A'
+		);
+	`
+	s.execute(tableSQL)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestForeignKeyColumnOrder() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" DECIMAL(18,0),
+			PRIMARY KEY ("A","B") ENABLE
+		);
+	`
+	// The referencing columns are deliberately not in table order
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"X" DECIMAL(18,0),
+			"Y" DECIMAL(18,0),
+			"Z" DECIMAL(18,0),
+			CONSTRAINT "T2_FK" FOREIGN KEY ("Z","X") REFERENCES "test"."T1" ("A","B") DISABLE
+		);
+	`
+	s.execute(table1SQL, table2SQL)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestIdentityColumn() {
+	run := newBackupRun()
+	s.execute(`CREATE OR REPLACE TABLE [test].T2 (
+		A DECIMAL(18,0) IDENTITY 321 NOT NULL COMMENT IS 'column A comment',
+		B DECIMAL(18,0) DEFAULT 123 CONSTRAINT "cnst" NOT NULL DISABLE
+	)`)
+	s.backup(Conf{}, TABLES)
+	tables, _, err := getTablesToBackup(s.exaConn, Criteria{"test.T2", ""})
+	s.NoError(err)
+	s.NoError(addTableColumns(s.exaConn, tables, Criteria{"test.T2", ""}))
+	s.NoError(addTableConstraints(s.exaConn, tables, Criteria{"test.T2", ""}))
+	s.Equal(
+		`"A" DECIMAL(18,0) IDENTITY 321 NOT NULL ENABLE COMMENT IS 'column A comment'`,
+		run.getColumnSQL(tables[0], tables[0].columns[0]),
+	)
+	s.Equal(
+		`"B" DECIMAL(18,0) DEFAULT 123 CONSTRAINT "cnst" NOT NULL DISABLE`,
+		run.getColumnSQL(tables[0], tables[0].columns[1]),
+	)
+
+	// Restoring the DDL reproduces the same columns
+	tableSQL, err := ioutil.ReadFile(filepath.Join(s.testDir, "schemas", "test", "tables", "T2.sql"))
+	s.NoError(err)
+	s.execute("DROP TABLE [test].T2", string(tableSQL))
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T2.sql": string(tableSQL),
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestDecimalPrecision() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(36,0),
+			"B" DECIMAL(36,18),
+			"C" DECIMAL(1,1)
+		);
+	`
+	s.execute(tableSQL)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestUnicodeComments() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0) COMMENT IS 'カラム 😀'
+		) COMMENT IS '日本語 😀';
+	`
+	s.execute(tableSQL)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+	fp := filepath.Join(s.testDir, "schemas", "test", "tables", "T1.sql")
+	backedUp, err := ioutil.ReadFile(fp)
+	s.NoError(err)
+	s.False(strings.HasPrefix(string(backedUp), "\xEF\xBB\xBF"), "No BOM")
+	s.Contains(string(backedUp), "'日本語 😀'")
+
+	// Applying the backed up DDL reproduces it byte for byte
+	s.execute("DROP TABLE [test].T1", string(backedUp))
+	s.backup(Conf{}, TABLES)
+	restored, err := ioutil.ReadFile(fp)
+	s.NoError(err)
+	s.Equal(backedUp, restored)
+}
+
+func (s *testSuite) TestPartitionKeyOrder() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" DECIMAL(18,0),
+			"C" DATE,
+			DISTRIBUTE BY "A","B",
+			PARTITION BY "C","B","A"
+		);
+	`
+	s.execute(tableSQL)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestConstraintStates() {
+	// The backup must not depend on the default constraint state
+	s.execute("ALTER SESSION SET CONSTRAINT_STATE_DEFAULT = 'DISABLE'")
+	defer s.execute("ALTER SESSION SET CONSTRAINT_STATE_DEFAULT = 'ENABLE'")
+	s.execute(`
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0) NOT NULL ENABLE,
+			"B" DECIMAL(18,0) CONSTRAINT "nn" NOT NULL DISABLE,
+			"C" DECIMAL(18,0) NOT NULL
+		)
+	`)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": `
+						CREATE OR REPLACE TABLE "test"."T1" (
+							"A" DECIMAL(18,0) NOT NULL ENABLE,
+							"B" DECIMAL(18,0) CONSTRAINT "nn" NOT NULL DISABLE,
+							"C" DECIMAL(18,0) NOT NULL DISABLE
+						);
+					`,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestGeometryColumns() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" GEOMETRY(4326),
+			"B" GEOMETRY(3857),
+			"C" GEOMETRY(0)
+		);
+	`
+	s.execute(tableSQL)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestCharacterColumns() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" CHAR(10) UTF8,
+			"B" CHAR(2000) ASCII,
+			"C" VARCHAR(10) UTF8,
+			"D" VARCHAR(255) ASCII,
+			"E" VARCHAR(2000000) UTF8,
+			"F" VARCHAR(2000000) ASCII
+		);
+	`
+	s.execute(tableSQL)
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestCommentsJSON() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0) COMMENT IS 'column A comment',
+			"B" DECIMAL(18,0) COMMENT IS 'column B <comment> – ü',
+			"C" DECIMAL(18,0)
+		) COMMENT IS 'table comment';
+	`
+	s.execute(tableSQL)
+	s.backup(Conf{EmitCommentsJSON: true}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"comments.json": `{
+					"objects": {
+						"T2": {
+							"type": "TABLE",
+							"comment": "table comment",
+							"columns": {
+								"A": "column A comment",
+								"B": "column B <comment> – ü"
+							}
+						}
+					}
+				}
+				`,
+				"tables": dt{
+					"T2.sql": tableSQL,
+				},
+			},
+		},
+	})
+
+	// Filtered out objects are left out and renamed ones are renamed
+	s.execute(`CREATE OR REPLACE TABLE [test].T3 (A DECIMAL(18,0) COMMENT IS 'T3 A') COMMENT IS 'T3'`)
+	os.RemoveAll(s.testDir)
+	s.backup(Conf{
+		EmitCommentsJSON: true,
+		ObjectFilter: func(o DiscoveredObject) bool {
+			return o.Name != "T3"
+		},
+		RenameFunc: func(objType Object, schema, name string) (string, string) {
+			if objType == TABLES && name == "T2" {
+				return schema, "T2_NEW"
+			}
+			return schema, name
+		},
+	}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"comments.json": `{
+					"objects": {
+						"T2_NEW": {
+							"type": "TABLE",
+							"comment": "table comment",
+							"columns": {
+								"A": "column A comment",
+								"B": "column B <comment> – ü"
+							}
+						}
+					}
+				}
+				`,
+				"tables": dt{
+					"T2_NEW.sql": strings.Replace(tableSQL, `"T2"`, `"T2_NEW"`, 1),
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestDataSampleStrategy() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL)
+	var values []string
+	for i := 0; i < 100; i++ {
+		values = append(values, fmt.Sprintf("(%d)", i))
+	}
+	s.execute(`INSERT INTO [test].T1 VALUES ` + strings.Join(values, ","))
+	sample := func(strategy DataSample) string {
+		s.backup(Conf{MaxTableRows: 10, DataSampleStrategy: strategy}, TABLES)
+		fp := filepath.Join(s.testDir, "schemas", "test", "tables", "T1.csv")
+		data, err := ioutil.ReadFile(fp)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		s.NoError(err)
+		os.Remove(fp)
+		return string(data)
+	}
+
+	// The manifest records what the data is a sample of
+	sampled := func() *dataManifest {
+		m, err := readManifest(s.testDir)
+		s.NoError(err)
+		s.Contains(m.Data, "schemas/test/tables/T1.csv")
+		return m.Data["schemas/test/tables/T1.csv"]
+	}
+
+	s.Equal("", sample(NO_SAMPLE))
+	s.Equal(&dataManifest{Skipped: skippedRowLimit}, sampled())
+	first := sample(FIRST_ROWS)
+	s.Equal("0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n", first)
+	s.Equal(&sampleManifest{Strategy: "FIRST_ROWS", Rows: 10, TableRows: 100}, sampled().Sample)
+	s.Equal("0\n10\n20\n30\n40\n50\n60\n70\n80\n90\n", sample(SYSTEMATIC_ROWS))
+	s.Equal(&sampleManifest{Strategy: "SYSTEMATIC_ROWS", Rows: 10, TableRows: 100, Every: 10}, sampled().Sample)
+	random := sample(RANDOM_ROWS)
+	s.Len(strings.Split(strings.TrimSpace(random), "\n"), 10)
+	s.NotEqual(first, random)
+	s.Equal(&sampleManifest{Strategy: "RANDOM_ROWS", Rows: 10, TableRows: 100}, sampled().Sample)
+}
+
+func (s *testSuite) TestTableRowLimits() {
+	tableSQL := func(name string) string {
+		return `CREATE OR REPLACE TABLE "test"."` + name + `" ("A" DECIMAL(18,0));`
+	}
+	for _, t := range []string{"T1", "T2", "T3"} {
+		s.execute(tableSQL(t), `INSERT INTO [test].`+t+` VALUES (1), (2), (3)`)
+	}
+	s.backup(Conf{
+		MaxTableRows:       2,
+		DataSampleStrategy: FIRST_ROWS,
+		TableRowLimits:     map[string]int{"test.T2": -1, "test.T3": 0},
+	}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL("T1"),
+					"T1.csv": "1\n2\n",
+					"T2.sql": tableSQL("T2"),
+					"T2.csv": "1\n2\n3\n",
+					"T3.sql": tableSQL("T3"),
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"data": {
+					"schemas/test/tables/T1.csv": {
+						"sample": {
+							"strategy": "FIRST_ROWS",
+							"rows": 2,
+							"tableRows": 3
+						}
+					},
+					"schemas/test/tables/T3.csv": {
+						"skipped": "row limit"
+					}
+				}
+			}
+		`,
+	})
+
+	// An override alone is enough to back up data
+	os.RemoveAll(s.testDir)
+	s.backup(Conf{TableRowLimits: map[string]int{"test.T3": 5}}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL("T1"),
+					"T2.sql": tableSQL("T2"),
+					"T3.sql": tableSQL("T3"),
+					"T3.csv": "1\n2\n3\n",
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"data": {
+					"schemas/test/tables/T1.csv": {
+						"skipped": "row limit"
+					},
+					"schemas/test/tables/T2.csv": {
+						"skipped": "row limit"
+					}
+				}
+			}
+		`,
+	})
+}
+
+func (s *testSuite) TestFileHeader() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	scriptSQL := `CREATE OR REPLACE LUA SCRIPT "SCR" () RETURNS ROWCOUNT AS
+		output('hello')
+	`
+	s.execute(tableSQL, "OPEN SCHEMA [test]", scriptSQL)
+	header := func(object string) string {
+		return fmt.Sprintf("-- Generated by go-exasol-backup from %s for %s\n", *testHost, object)
+	}
+	s.backup(Conf{FileHeader: true}, SCHEMAS, TABLES, SCRIPTS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": header("test") + s.schemaSQL,
+				"tables": dt{
+					"T1.sql": header("test.T1") + tableSQL,
+				},
+				"scripts": dt{
+					"SCR.sql": header("test.SCR") + "OPEN SCHEMA [test];\n--/\n" + scriptSQL + "\n/\n",
+				},
+			},
+		},
+	})
+
+	s.backup(Conf{FileHeader: true, FileHeaderTimestamp: true}, SCHEMAS)
+	fp := filepath.Join(s.testDir, "schemas", "test", "schema.sql")
+	data, err := ioutil.ReadFile(fp)
+	s.NoError(err)
+	s.Regexp(
+		`^-- Generated by go-exasol-backup from \S+ at \d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ for test\n`,
+		string(data),
+	)
+}
+
+func (s *testSuite) TestEncrypt() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES 1, 2`)
+	enc := &EncryptConfig{Key: []byte("0123456789abcdef0123456789abcdef")}
+	s.backup(Conf{MaxTableRows: 100, Encrypt: enc}, TABLES)
+	tableFile := filepath.Join(s.testDir, "schemas", "test", "tables", "T1.sql")
+	_, err := os.Stat(tableFile)
+	s.True(os.IsNotExist(err))
+	data, err := ioutil.ReadFile(tableFile + ".enc")
+	s.NoError(err)
+	s.True(strings.HasPrefix(string(data), "EXASOL-BACKUP AES-256-GCM-STREAM\n"))
+	s.NotContains(string(data), "CREATE")
+	manifest, err := readManifest(s.testDir)
+	s.NoError(err)
+	s.Equal(&encryptionManifest{
+		Algorithm: "AES-256-GCM-STREAM",
+		Files: []string{
+			"schemas/test/tables/T1.csv.enc",
+			"schemas/test/tables/T1.sql.enc",
+			"session.sql.enc",
+		},
+	}, manifest.Encryption)
+	f, err := OpenBackupFile(tableFile, enc)
+	s.NoError(err)
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	s.NoError(err)
+	s.Contains(string(data), `CREATE OR REPLACE TABLE "test"."T1"`)
+
+	s.Error(DecryptBackup(s.testDir, &EncryptConfig{Key: []byte("fedcba9876543210fedcba9876543210")}))
+	s.NoError(DecryptBackup(s.testDir, enc))
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1\n2\n",
+				},
+			},
+		},
+	})
+
+	// Files are encrypted as they're written so even a failing
+	// backup (and the data of any size) is never left in plaintext.
+	os.RemoveAll(s.testDir)
+	var values []string
+	for i := 0; i < 20000; i++ {
+		values = append(values, fmt.Sprintf("(%d)", i))
+	}
+	s.execute(`INSERT INTO [test].T1 VALUES ` + strings.Join(values, ","))
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T2 (A DECIMAL(18,0))`,
+		`INSERT INTO [test].T2 VALUES 1`,
+	)
+	var written []string
+	err = Backup(Conf{
+		Source:          s.exaConn,
+		Destination:     s.testDir,
+		LogLevel:        s.loglevel,
+		Objects:         []Object{TABLES},
+		MaxTableRows:    100000,
+		Encrypt:         enc,
+		DataExportHints: map[string]string{"test.T2": "BOOLEAN = 'BOGUS'"},
+		OnFileWritten: func(relPath string, size int64, checksum string) {
+			written = append(written, relPath)
+		},
+	})
+	s.Error(err)
+	s.NotEmpty(written)
+	for _, relPath := range written {
+		s.True(strings.HasSuffix(relPath, ".enc"), relPath)
+	}
+	filepath.Walk(s.testDir, func(fp string, fi os.FileInfo, err error) error {
+		s.NoError(err)
+		if !fi.IsDir() {
+			s.True(strings.HasSuffix(fp, ".enc"), fp)
+		}
+		return nil
+	})
+	csvFile := filepath.Join(s.testDir, "schemas", "test", "tables", "T1.csv")
+	f, err = OpenBackupFile(csvFile, enc)
+	s.NoError(err)
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	s.NoError(err)
+	s.Len(strings.Split(strings.TrimSpace(string(data)), "\n"), 20002)
+
+	// Truncated files don't decrypt
+	fi, err := os.Stat(csvFile + ".enc")
+	s.NoError(err)
+	s.NoError(os.Truncate(csvFile+".enc", fi.Size()-100))
+	s.Error(DecryptBackup(s.testDir, enc))
+
+}
+
+func (s *testSuite) TestOnStartOnFinish() {
+	s.execute(`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0))`)
+	s.execute("OPEN SCHEMA [test]", "CREATE OR REPLACE VIEW V1 AS SELECT * FROM T1")
+	var plans []Plan
+	var summaries []Summary
+	var errs []error
+	conf := Conf{
+		OnStart: func(p Plan) { plans = append(plans, p) },
+		OnFinish: func(sum Summary, err error) {
+			summaries = append(summaries, sum)
+			errs = append(errs, err)
+		},
+	}
+	s.backup(conf, TABLES, VIEWS)
+	s.Len(plans, 1)
+	s.Equal([]Object{TABLES, VIEWS}, plans[0].Objects)
+	s.Equal(s.testDir, plans[0].Destination)
+	s.Len(summaries, 1)
+	s.Equal(2, summaries[0].FilesWritten)
+	s.Greater(summaries[0].BytesWritten, int64(0))
+	s.NoError(errs[0])
+
+	// OnFinish still fires when the backup fails part way
+	plans, summaries, errs = nil, nil, nil
+	err := Backup(Conf{
+		Source:      s.exaConn,
+		Destination: s.testDir,
+		LogLevel:    s.loglevel,
+		Objects:     []Object{TABLES, VIEWS},
+		TransformDDL: func(objType Object, schema, name, ddl string) (string, error) {
+			return "", fmt.Errorf("bad DDL")
+		},
+		OnStart:  conf.OnStart,
+		OnFinish: conf.OnFinish,
+	})
+	s.Error(err)
+	s.Len(plans, 1)
+	s.Len(summaries, 1)
+	s.Equal(err, errs[0])
+
+	// And when it fails before it even starts
+	plans, summaries, errs = nil, nil, nil
+	err = Backup(Conf{
+		Source:      s.exaConn,
+		Destination: filepath.Join(s.testDir, "missing"),
+		LogLevel:    s.loglevel,
+		Objects:     []Object{TABLES},
+		OnStart:     conf.OnStart,
+		OnFinish:    conf.OnFinish,
+	})
+	s.Error(err)
+	s.Len(plans, 0)
+	s.Len(summaries, 1)
+	s.Equal(err, errs[0])
+
+	// A panic in a parallel object type reaches the
+	// caller (and OnFinish) rather than the process.
+	s.exaConn.Commit()
+	factory := func() (*exasol.Conn, error) {
+		return exasol.Connect(exasol.ConnConf{
+			Host:      *testHost,
+			Port:      uint16(*testPort),
+			Username:  "SYS",
+			Password:  *testPass,
+			Logger:    log,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+	}
+	plans, summaries, errs = nil, nil, nil
+	s.PanicsWithValue("boom", func() {
+		Backup(Conf{
+			Source:              s.exaConn,
+			ConnectionFactory:   factory,
+			ParallelObjectTypes: true,
+			Destination:         s.testDir,
+			LogLevel:            s.loglevel,
+			Objects:             []Object{PARAMETERS},
+			OnFileWritten:       func(string, int64, string) { panic("boom") },
+			OnFinish:            conf.OnFinish,
+		})
+	})
+	s.Len(summaries, 1)
+	s.EqualError(errs[0], "Backup panicked: boom")
+}
+
+func (s *testSuite) TestAtomicWrites() {
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0))`,
+		`INSERT INTO [test].T1 VALUES 1, 2, 3`,
+		"DROP USER IF EXISTS joe",
+		"CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe'",
+		"GRANT CREATE SESSION TO [JOE]",
+	)
+	atomicWrites := false
+	for _, conf := range []Conf{
+		{MaxTableRows: 100},
+		{MaxTableRows: 100, MaxRowsPerFile: 2},
+		{MaxTableRows: 100, AtomicWrites: &atomicWrites},
+	} {
+		var written []string
+		conf.OnFileWritten = func(relPath string, size int64, checksum string) {
+			written = append(written, relPath)
+		}
+		s.backup(conf, TABLES, USERS)
+		s.NotEmpty(written)
+		filepath.Walk(s.testDir, func(fp string, fi os.FileInfo, err error) error {
+			s.NoError(err)
+			s.False(strings.HasSuffix(fp, ".tmp"), fp)
+			return nil
+		})
+	}
+	userSQL, err := ioutil.ReadFile(filepath.Join(s.testDir, "users", "JOE.sql"))
+	s.NoError(err)
+	s.Contains(string(userSQL), "GRANT CREATE SESSION TO [JOE];\n")
+
+	dataFiles := func() map[string]string {
+		files := map[string]string{}
+		matches, _ := filepath.Glob(filepath.Join(s.testDir, "schemas", "test", "tables", "T1*"))
+		for _, fp := range matches {
+			if strings.HasSuffix(fp, ".sql") {
+				continue
+			}
+			data, err := ioutil.ReadFile(fp)
+			s.NoError(err)
+			files[filepath.Base(fp)] = string(data)
+		}
+		return files
+	}
+	// A failed export keeps the previous backup's data (split or not)
+	for _, conf := range []Conf{
+		{MaxTableRows: 100},
+		{MaxTableRows: 100, MaxRowsPerFile: 2},
+	} {
+		os.RemoveAll(s.testDir)
+		s.backup(conf, TABLES)
+		before := dataFiles()
+		s.NotEmpty(before)
+		conf.Source = s.exaConn
+		conf.Destination = s.testDir
+		conf.LogLevel = s.loglevel
+		conf.Objects = []Object{TABLES}
+		conf.DataExportHints = map[string]string{"test.T1": "BOOLEAN = 'BOGUS'"}
+		s.Error(Backup(conf))
+		s.Equal(before, dataFiles())
+	}
+	// The previous backup's chunks are only removed once the new data is in place
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.Equal(map[string]string{"T1.csv": "1\n2\n3\n"}, dataFiles())
+}
+
+type testMetrics struct {
+	durations map[Object]int
+	bytes     int64
+	errors    map[Object]int
+	objects   map[Object]int
+}
+
+func (m *testMetrics) ObserveDuration(obj Object, d time.Duration) { m.durations[obj]++ }
+func (m *testMetrics) AddBytes(n int64)                            { m.bytes += n }
+func (m *testMetrics) IncError(obj Object)                         { m.errors[obj]++ }
+func (m *testMetrics) IncObjects(obj Object, n int)                { m.objects[obj] += n }
+
+func (s *testSuite) TestMetrics() {
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0))`,
+		`CREATE OR REPLACE TABLE [test].T2 (A DECIMAL(18,0))`,
+	)
+	s.execute("OPEN SCHEMA [test]", "CREATE OR REPLACE VIEW V1 AS SELECT * FROM T1")
+	newMetrics := func() *testMetrics {
+		return &testMetrics{
+			durations: map[Object]int{},
+			errors:    map[Object]int{},
+			objects:   map[Object]int{},
+		}
+	}
+	m := newMetrics()
+	s.backup(Conf{Metrics: m}, SCHEMAS, TABLES, VIEWS)
+	s.Equal(map[Object]int{SCHEMAS: 1, TABLES: 1, VIEWS: 1}, m.durations)
+	s.Equal(map[Object]int{SCHEMAS: 1, TABLES: 2, VIEWS: 1}, m.objects)
+	s.Empty(m.errors)
+	var size int64
+	filepath.Walk(s.testDir, func(fp string, fi os.FileInfo, err error) error {
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	s.Equal(size, m.bytes)
+
+	m = newMetrics()
+	s.backup(Conf{
+		Metrics: m,
+		TransformDDL: func(objType Object, schema, name, ddl string) (string, error) {
+			return "", fmt.Errorf("bad DDL")
+		},
+	}, TABLES)
+	s.Equal(map[Object]int{TABLES: 1}, m.errors)
+}
+
+func (s *testSuite) TestOnFileWritten() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES 1, 2`)
+	s.execute("OPEN SCHEMA [test]", "CREATE OR REPLACE VIEW V1 AS SELECT * FROM T1")
+	written := map[string]string{}
+	var calls int
+	conf := Conf{
+		MaxTableRows: 100,
+		MaxViewRows:  100,
+		OnFileWritten: func(relPath string, size int64, checksum string) {
+			calls++
+			written[relPath] = checksum
+			fi, err := os.Stat(filepath.Join(s.testDir, relPath))
+			s.NoError(err)
+			s.Equal(fi.Size(), size)
+		},
+	}
+	s.backup(conf, SCHEMAS, TABLES, VIEWS, ROLES)
+
+	// Every file was reported exactly once with its checksum
+	var files []string
+	filepath.Walk(s.testDir, func(fp string, fi os.FileInfo, err error) error {
+		s.NoError(err)
+		if !fi.IsDir() {
+			relPath, _ := filepath.Rel(s.testDir, fp)
+			files = append(files, relPath)
+			sum, err := fileChecksum(fp)
+			s.NoError(err)
+			s.Equal(sum, written[relPath], relPath)
+		}
+		return nil
+	})
+	s.ElementsMatch([]string{
+		"session.sql",
+		"schemas/test/schema.sql",
+		"schemas/test/tables/T1.sql",
+		"schemas/test/tables/T1.csv",
+		"schemas/test/views/V1.sql",
+		"schemas/test/views/V1.csv",
+		"roles/DBA.sql",
+		"roles/PUBLIC.sql",
+	}, files)
+	s.Equal(len(files), calls)
+}
+
+func (s *testSuite) TestIdentifierQuote() {
+	s.execute(
+		"OPEN SCHEMA [test]",
+		"CREATE TABLE T1 (A DECIMAL(18,0) NOT NULL, B DECIMAL(18,0), CONSTRAINT T1_PK PRIMARY KEY (A))",
+		"CREATE TABLE T2 (A DECIMAL(18,0), CONSTRAINT T2_FK FOREIGN KEY (A) REFERENCES T1 (A))",
+		"CREATE VIEW V1 AS SELECT A FROM T1",
+		"CREATE LUA SCRIPT SCR () RETURNS ROWCOUNT AS output('hello')",
+		"COMMENT ON SCRIPT SCR IS 'script comment'",
+		"DROP USER IF EXISTS joe",
+		"CREATE USER JOE IDENTIFIED BY KERBEROS PRINCIPAL 'joe'",
+		"GRANT SELECT ON T1 TO JOE",
+	)
+	sqlFiles := func() map[string]string {
+		files := map[string]string{}
+		filepath.Walk(s.testDir, func(fp string, fi os.FileInfo, err error) error {
+			if !fi.IsDir() && filepath.Ext(fp) == ".sql" {
+				data, err := ioutil.ReadFile(fp)
+				s.NoError(err)
+				files[fp] = string(data)
+			}
+			return nil
+		})
+		return files
+	}
+	objects := []Object{SCHEMAS, TABLES, VIEWS, SCRIPTS, USERS}
+
+	s.backup(Conf{IdentifierQuote: DOUBLE_QUOTES}, objects...)
+	files := sqlFiles()
+	s.Len(files, 6)
+	for fp, sql := range files {
+		s.NotContains(sql, "[", fp)
+	}
+	s.Contains(files[filepath.Join(s.testDir, "users", "JOE.sql")],
+		`GRANT SELECT ON TABLE "test"."T1" TO "JOE";`)
+
+	os.RemoveAll(s.testDir)
+	os.Mkdir(s.testDir, os.ModePerm)
+	s.backup(Conf{IdentifierQuote: BRACKET_QUOTES}, objects...)
+	files = sqlFiles()
+	s.Len(files, 6)
+	for fp, sql := range files {
+		s.NotContains(sql, `"`, fp)
+	}
+	s.Contains(files[filepath.Join(s.testDir, "schemas", "test", "tables", "T2.sql")],
+		`CONSTRAINT [T2_FK] FOREIGN KEY ([A]) REFERENCES [test].[T1] ([A]) ENABLE`)
+
+	// A ] within a bracketed identifier is doubled
+	s.execute("CREATE OR REPLACE TABLE [test].[T]]3] (A DECIMAL(18,0))")
+	s.backup(Conf{IdentifierQuote: BRACKET_QUOTES}, TABLES)
+	s.Contains(sqlFiles()[filepath.Join(s.testDir, "schemas", "test", "tables", "T]3.sql")],
+		`CREATE OR REPLACE TABLE [test].[T]]3] (`)
+	s.Equal("[T]]3]", bracket("T]3"))
+}
+
+func (s *testSuite) TestTableColumnOrder() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"C" DECIMAL(18,0),
+			"D" DECIMAL(18,0)
+		);
+	`
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0), B DECIMAL(18,0), C DECIMAL(18,0))`,
+		`ALTER TABLE [test].T1 DROP COLUMN B`,
+		`ALTER TABLE [test].T1 ADD COLUMN D DECIMAL(18,0)`,
+		`INSERT INTO [test].T1 VALUES (1,3,4), (2,5,6)`,
+	)
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1,3,4\n2,5,6\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestDataWhereByColumn() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"TENANT_ID" DECIMAL(18,0),
+			"A" DECIMAL(18,0)
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	data1SQL := `INSERT INTO [test].T1 VALUES (1,2), (2,3), (3,4);`
+	data2SQL := `INSERT INTO [test].T2 VALUES 1, 2, 3;`
+	s.execute(table1SQL, table2SQL, data1SQL, data2SQL)
+	s.backup(Conf{
+		MaxTableRows:      100,
+		DataWhereByColumn: map[string]string{"tenant_id": "TENANT_ID IN (1, 3)"},
+	}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+					"T1.csv": "1,2\n3,4\n",
+					"T2.csv": "1\n2\n3\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestMaxRowsPerFile() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" VARCHAR(20) UTF8
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1
+		SELECT i, CASE WHEN i = 2 THEN 'multi' || CHR(10) || 'line' END
+		FROM VALUES BETWEEN 1 AND 10 AS v(i)`)
+	s.backup(Conf{MaxTableRows: 100, MaxRowsPerFile: 3, DropExtras: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql":     tableSQL,
+					"T1.000.csv": "1,\n2,\"multi\nline\"\n3,\n",
+					"T1.001.csv": "4,\n5,\n6,\n",
+					"T1.002.csv": "7,\n8,\n9,\n",
+					"T1.003.csv": "10,\n",
+				},
+			},
+		},
+	})
+
+	// The rows are split by the hinted format with the column names in each file
+	s.backup(Conf{
+		MaxTableRows:    100,
+		MaxRowsPerFile:  4,
+		DataExportHints: map[string]string{"test.T1": "ROW SEPARATOR = 'CR' WITH COLUMN NAMES"},
+	}, TABLES)
+	dir := filepath.Join(s.testDir, "schemas", "test", "tables")
+	for file, csv := range map[string]string{
+		"T1.000.csv": "A,B\r1,\r2,\"multi\nline\"\r3,\r4,\r",
+		"T1.001.csv": "A,B\r5,\r6,\r7,\r8,\r",
+		"T1.002.csv": "A,B\r9,\r10,\r",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file))
+		s.NoError(err)
+		s.Equal(csv, string(data), file)
+	}
+	_, err := os.Stat(filepath.Join(dir, "T1.003.csv"))
+	s.True(os.IsNotExist(err))
+
+	// Switching back to unsplit data replaces the chunks
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1,\n2,\"multi\nline\"\n3,\n4,\n5,\n6,\n7,\n8,\n9,\n10,\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestSkipEmptyTablesData() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(table1SQL, table2SQL, `INSERT INTO [test].T1 VALUES 1, 2`)
+	where := map[string]string{"A": "A < 0"}
+
+	// By default an export returning no rows leaves an empty file
+	s.backup(Conf{MaxTableRows: 100, DataWhereByColumn: where}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T1.csv": "",
+					"T2.sql": table2SQL,
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"data": {
+					"schemas/test/tables/T2.csv": {
+						"empty": true
+					}
+				}
+			}
+		`,
+	})
+
+	s.backup(Conf{MaxTableRows: 100, DataWhereByColumn: where, SkipEmptyTablesData: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"data": {
+					"schemas/test/tables/T1.csv": {
+						"empty": true
+					},
+					"schemas/test/tables/T2.csv": {
+						"empty": true
+					}
+				}
+			}
+		`,
+	})
+
+	// Data backed up before a table is emptied is dropped
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.execute(`DELETE FROM [test].T1`)
+	s.backup(Conf{MaxTableRows: 100, DropExtras: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"data": {
+					"schemas/test/tables/T1.csv": {
+						"empty": true
+					},
+					"schemas/test/tables/T2.csv": {
+						"empty": true
+					}
+				}
+			}
+		`,
+	})
+}
+
+func (s *testSuite) TestDataColumnOrder() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" VARCHAR(10) UTF8,
+			"C" DECIMAL(18,0)
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0),
+			"B" DECIMAL(18,0)
+		);
+	`
+	s.execute(table1SQL, table2SQL,
+		`INSERT INTO [test].T1 VALUES (1, 'x', 10)`,
+		`INSERT INTO [test].T2 VALUES (1, 2)`,
+	)
+	order := map[string][]string{"test.T1": {"b", "A"}}
+	s.backup(Conf{MaxTableRows: 100, DataColumnOrder: order}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T1.csv": "x,1,10\n",
+					"T2.sql": table2SQL,
+					"T2.csv": "1,2\n",
+				},
+			},
+		},
+	})
+
+	s.backup(Conf{MaxTableRows: 100, DataColumnOrder: order, DataColumnOrderOnly: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T1.csv": "x,1\n",
+					"T2.sql": table2SQL,
+					"T2.csv": "1,2\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestDataSink() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" VARCHAR(100) UTF8
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES (2, 'x,y'), (3, 'a "b"')`)
+	var gotHeader []string
+	var gotRows [][]string
+	sink := func(schema, table string, header []string, rows <-chan []string) error {
+		s.Equal("test.T1", schema+"."+table)
+		gotHeader = header
+		for row := range rows {
+			gotRows = append(gotRows, row)
+		}
+		return nil
+	}
+	s.backup(Conf{MaxTableRows: 100, DataSink: sink}, TABLES)
+	s.Equal([]string{"A", "B"}, gotHeader)
+	s.Equal([][]string{{"2", "x,y"}, {"3", `a "b"`}}, gotRows)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+
+	// The sink only gets plain CSV parsed
+	for _, hint := range []string{"WITH COLUMN NAMES", "ROW SEPARATOR = 'CR'", "COLUMN SEPARATOR = ';'"} {
+		err := Backup(Conf{
+			Source:          s.exaConn,
+			Destination:     s.testDir,
+			LogLevel:        s.loglevel,
+			Objects:         []Object{TABLES},
+			MaxTableRows:    100,
+			DataSink:        sink,
+			DataExportHints: map[string]string{"test.T1": hint},
+		})
+		s.Error(err, hint)
+	}
+}
+
+func (s *testSuite) TestDataQueryTransform() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" VARCHAR(100) UTF8
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0),
+			"B" VARCHAR(100) UTF8
+		);
+	`
+	data1SQL := `INSERT INTO [test].T1 VALUES (1,'hello'), (2,'bye')`
+	data2SQL := `INSERT INTO [test].T2 VALUES (1,'hello'), (2,'bye')`
+	s.execute(table1SQL, table2SQL, data1SQL, data2SQL)
+	s.backup(Conf{
+		MaxTableRows: 100,
+		DataQueryTransform: func(schema, object string, cols []Column) (string, bool) {
+			if object != "T1" {
+				return "", false
+			}
+			s.Equal([]Column{
+				{Name: "A", Type: "DECIMAL(18,0)"},
+				{Name: "B", Type: "VARCHAR(100) UTF8"},
+			}, cols)
+			return "A, LENGTH(B) AS B", true
+		},
+	}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+					"T1.csv": "1,5\n2,3\n",
+					"T2.csv": "1,hello\n2,bye\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestNoDataColumnTypes() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" GEOMETRY(4326),
+			"C" VARCHAR(10) UTF8,
+			"D" HASHTYPE(16 BYTE)
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES (1, 'POINT (1 2)', 'x', 'ab12cd34ab12cd34ab12cd34ab12cd34')`)
+	s.backup(Conf{MaxTableRows: 100, NoDataColumnTypes: []string{"geometry", "HASHTYPE"}}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1,,x,\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestDataExportNullForUnsupportedTypes() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" GEOMETRY(4326)
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES (1, 'POINT (1 2)')`)
+	// Pretend GEOMETRY is a type the backup doesn't know
+	defer func(orig []string) { supportedColumnTypes = orig }(supportedColumnTypes)
+	supportedColumnTypes = []string{"DECIMAL"}
+	s.backup(Conf{MaxTableRows: 100, DataExportNullForUnsupportedTypes: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1,\n",
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"data": {
+					"schemas/test/tables/T1.csv": {
+						"warnings": [
+							"Column B of unsupported type GEOMETRY(4326) was backed up as NULL"
+						]
+					}
+				}
+			}
+		`,
+	})
+
+	err := Backup(Conf{
+		Source:                            s.exaConn,
+		Destination:                       s.testDir,
+		LogLevel:                          s.loglevel,
+		Objects:                           []Object{TABLES},
+		MaxTableRows:                      100,
+		DataExportNullForUnsupportedTypes: true,
+		StrictMode:                        true,
+	})
+	s.Error(err)
+}
+
+func (s *testSuite) TestDataExportHints() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" BOOLEAN
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES (1, true), (2, false)`)
+	s.backup(Conf{
+		MaxTableRows:    100,
+		DataExportHints: map[string]string{"test.T1": "BOOLEAN = 'yes/no'"},
+	}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1,yes\n2,no\n",
+				},
+			},
+		},
+	})
+
+	err := Backup(Conf{
+		Source:          s.exaConn,
+		Destination:     s.testDir,
+		LogLevel:        s.loglevel,
+		Objects:         []Object{TABLES},
+		DataExportHints: map[string]string{"test.T1": "; DROP TABLE [test].T1"},
+	})
+	s.Error(err)
+
+	for _, hint := range []string{
+		"BOOLEAN = 'yes/no' NULL = 'x' DELIMIT = ALWAYS",
+		"row separator='CRLF' WITH COLUMN NAMES",
+	} {
+		s.True(dataExportHintRE.MatchString(hint), hint)
+	}
+	for _, hint := range []string{
+		"BOOLEAN = 'yes/no' -- comment",
+		"/*+ parallel */",
+		"NULL = 'a'' OR ''b'",
+		"BOOLEAN = 'a') UNION (SELECT 1",
+		"BOGUS OPTION",
+		"ENCODING = 'LATIN1'", // That's the OutputEncoding
+	} {
+		s.False(dataExportHintRE.MatchString(hint), hint)
+	}
+
+	s.Equal(csvFormat{
+		rowSeparator:    "CRLF",
+		columnSeparator: ";",
+		columnDelimiter: "|",
+		delimit:         "NEVER",
+		columnNames:     true,
+	}, parseCSVFormat("row separator='crlf' column  separator = ';' "+
+		"COLUMN DELIMITER = '|' DELIMIT = never WITH COLUMN NAMES"))
+	// An option's value isn't mistaken for an option
+	s.True(parseCSVFormat("NULL = 'WITH COLUMN NAMES'").isPlainCSV())
+}
+
+func (s *testSuite) TestOutputEncoding() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" VARCHAR(10) UTF8,
+			"B" BOOLEAN
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES ('é', true)`)
+	s.backup(Conf{
+		MaxTableRows:    100,
+		OutputEncoding:  "LATIN1",
+		DataExportHints: map[string]string{"test.T1": "BOOLEAN = 'yes/no'"},
+	}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "\xe9,yes\n",
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"encoding": "ISO-8859-1"
+			}
+		`,
+	})
+
+	// Not representable in LATIN1
+	s.execute(`INSERT INTO [test].T1 VALUES ('a😀b', false)`)
+	err := Backup(Conf{
+		Source:         s.exaConn,
+		Destination:    s.testDir,
+		LogLevel:       s.loglevel,
+		Objects:        []Object{TABLES},
+		MaxTableRows:   100,
+		OutputEncoding: "LATIN1",
+	})
+	s.Error(err)
+	// The previous data is kept
+	data, err := ioutil.ReadFile(filepath.Join(s.testDir, "schemas", "test", "tables", "T1.csv"))
+	s.NoError(err)
+	s.Equal("\xe9,yes\n", string(data))
+
+	for mode, csv := range map[EncodingErrorMode]string{
+		ENCODING_REPLACE: "\xe9,yes\na\x1ab,no\n",
+		ENCODING_SKIP:    "\xe9,yes\nab,no\n",
+	} {
+		s.backup(Conf{
+			MaxTableRows:      100,
+			OutputEncoding:    "LATIN1",
+			EncodingErrorMode: mode,
+			DataExportHints:   map[string]string{"test.T1": "BOOLEAN = 'yes/no'"},
+		}, TABLES)
+		data, err := ioutil.ReadFile(filepath.Join(s.testDir, "schemas", "test", "tables", "T1.csv"))
+		s.NoError(err)
+		s.Equal(csv, string(data))
+	}
+
+	// Only valid encodings and modes are accepted
+	for _, conf := range []Conf{
+		{OutputEncoding: "NOT-AN-ENCODING"},
+		{OutputEncoding: "LATIN1", EncodingErrorMode: ENCODING_SKIP + 1},
+	} {
+		conf.Source = s.exaConn
+		conf.Destination = s.testDir
+		conf.LogLevel = s.loglevel
+		conf.Objects = []Object{TABLES}
+		s.Error(Backup(conf))
+	}
+}
+
+func (s *testSuite) TestExportNLS() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" TIMESTAMP
+		);
+	`
+	dataSQL := `INSERT INTO [test].T1 VALUES '2020-01-02 03:04:05.678'`
+	s.execute(tableSQL, dataSQL)
+
+	// The connection's own format shouldn't matter
+	s.execute("ALTER SESSION SET NLS_TIMESTAMP_FORMAT='DD.MM.YYYY HH24:MI'")
+	defer s.execute("ALTER SESSION SET NLS_TIMESTAMP_FORMAT='YYYY-MM-DD HH24:MI:SS.FF3'")
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	// And it's left as it was
+	res, err := s.exaConn.FetchSlice(`
+		SELECT session_value FROM exa_parameters
+		WHERE parameter_name = 'NLS_TIMESTAMP_FORMAT'
+	`)
+	s.NoError(err)
+	s.Equal("DD.MM.YYYY HH24:MI", res[0][0])
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "2020-01-02 03:04:05.678\n",
+				},
+			},
+		},
+	})
+
+	// Test overriding the export format
+	nls := map[string]string{"NLS_TIMESTAMP_FORMAT": "YYYY-MM-DD\"T\"HH24:MI:SS"}
+	s.backup(Conf{MaxTableRows: 100, ExportNLS: nls}, TABLES)
+	s.expect(dt{
+		"session.sql": regexp.MustCompile(` HH24:MI:SS.FF3`).ReplaceAllString(
+			testSessionSQL, `"T"HH24:MI:SS`,
+		),
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "2020-01-02T03:04:05\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestIgnoreMissingObjects() {
+	run := newBackupRun()
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0))`,
+		`INSERT INTO [test].T1 VALUES 1, 2`,
+	)
+	crit := Criteria{"test.T1", ""}
+	tables, _, err := getTablesToBackup(s.exaConn, crit)
+	s.NoError(err)
+	s.Len(tables, 1)
+	s.NoError(addTableColumns(s.exaConn, tables, crit))
+
+	// Simulate the table being dropped between discovery and fetch
+	s.execute("DROP TABLE [test].T1")
+	out := make(chan *table, 1)
+	err = run.readTable(s.exaConn, tables[0], out, 100, nil)
+	s.NoError(err)
+	s.True((<-out).missing)
+
+	run.option.ignoreMissingObjects = false
+	tables[0].missing = false
+	err = run.readTable(s.exaConn, tables[0], out, 100, nil)
+	s.Error(err)
+	s.False((<-out).missing)
+}
+
+func (s *testSuite) TestResume() {
+	run := newBackupRun()
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(table1SQL, table2SQL)
+	s.execute(`INSERT INTO [test].T1 VALUES 1`, `INSERT INTO [test].T2 VALUES 2`)
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	// Only runs with Resume track their progress
+	_, err := os.Stat(filepath.Join(s.testDir, progressFile))
+	s.True(os.IsNotExist(err))
+
+	// Simulate a run that failed after completing T1's data
+	p, err := run.startProgress(s.testDir, true)
+	s.NoError(err)
+	s.NoError(p.markDone(filepath.Join("schemas", "test", "tables", "T1.csv")))
+
+	s.execute(`INSERT INTO [test].T1 VALUES 3`, `INSERT INTO [test].T2 VALUES 4`)
+	s.backup(Conf{MaxTableRows: 100, Resume: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+					"T1.csv": "1\n",
+					"T2.csv": "2\n4\n",
+				},
+			},
+		},
+	})
+
+	// Once finished nothing is resumed
+	s.backup(Conf{MaxTableRows: 100, Resume: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+					"T1.csv": "1\n3\n",
+					"T2.csv": "2\n4\n",
+				},
+			},
+		},
+	})
+
+	// Split data is resumed as a whole if it's split the same way
+	os.RemoveAll(s.testDir)
+	s.backup(Conf{MaxTableRows: 100, MaxRowsPerFile: 1}, TABLES)
+	run.option.maxRowsPerFile = 1
+	p, err = run.startProgress(s.testDir, true)
+	s.NoError(err)
+	s.NoError(p.markDone(filepath.Join("schemas", "test", "tables", "T1.csv")))
+	s.NoError(p.markDone(filepath.Join("schemas", "test", "tables", "T2.csv")))
+	s.execute(`INSERT INTO [test].T1 VALUES 5`, `INSERT INTO [test].T2 VALUES 6`)
+	os.Remove(filepath.Join(s.testDir, "schemas", "test", "tables", "T2.001.csv"))
+	s.backup(Conf{MaxTableRows: 100, MaxRowsPerFile: 1, Resume: true}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql":     table1SQL,
+					"T2.sql":     table2SQL,
+					"T1.000.csv": "1\n",
+					"T1.001.csv": "3\n",
+					"T2.000.csv": "2\n",
+					"T2.001.csv": "4\n",
+					"T2.002.csv": "6\n",
+				},
+			},
+		},
+	})
+
+}
+
+func (s *testSuite) TestTableWriteFailure() {
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0))`,
+		`CREATE OR REPLACE TABLE [test].T2 (A DECIMAL(18,0))`,
+		`INSERT INTO [test].T1 VALUES 1`,
+		`INSERT INTO [test].T2 VALUES 2`,
+	)
+	// A directory in the way of T1's data file makes the write fail
+	dir := filepath.Join(s.testDir, "schemas", "test", "tables")
+	s.NoError(os.MkdirAll(filepath.Join(dir, "T1.csv"), os.ModePerm))
+
+	err := BackupTables(s.exaConn, s.testDir, Criteria{"test", ""}, 100, nil, false)
+	s.Error(err)
+	s.NoFileExists(filepath.Join(dir, "T2.sql"))
+	s.NoFileExists(filepath.Join(dir, "T2.csv"))
+}
+
+func (s *testSuite) TestNameCase() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES 1`)
+	s.backup(Conf{MaxTableRows: 100, NameCase: LOWER_CASE}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"t1.sql": tableSQL,
+					"t1.csv": "1\n",
+				},
+			},
+		},
+	})
+
+	// Test --drop-extras
+	s.execute("DROP TABLE [test].T1")
+	s.backup(Conf{DropExtras: true, NameCase: LOWER_CASE}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestDeferConstraints() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" DECIMAL(18,0),
+			CONSTRAINT "T1_PK" PRIMARY KEY ("A") ENABLE
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0),
+			"B" DECIMAL(18,0),
+			CONSTRAINT "T2_PK" PRIMARY KEY ("A") ENABLE
+		);
+	`
+	fk1SQL := `ALTER TABLE "test"."T1" ADD CONSTRAINT "T1_FK" FOREIGN KEY ("B") REFERENCES "test"."T2" ("A") ENABLE;` + "\n"
+	fk2SQL := `ALTER TABLE "test"."T2" ADD CONSTRAINT "T2_FK" FOREIGN KEY ("B") REFERENCES "test"."T1" ("A") DISABLE;` + "\n"
+	s.execute(table1SQL, table2SQL, fk1SQL, fk2SQL)
+	s.backup(Conf{DeferConstraints: true}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"constraints.sql": fk1SQL + fk2SQL,
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+				},
+			},
+		},
+	})
+
+	// The backup can be restored in order
+	dir := filepath.Join(s.testDir, "schemas", "test")
+	read := func(file string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file))
+		s.NoError(err)
+		return string(data)
+	}
+	restoreSQL := []string{read("tables/T1.sql"), read("tables/T2.sql")}
+	restoreSQL = append(restoreSQL, strings.Split(strings.TrimSpace(read("constraints.sql")), "\n")...)
+	s.execute("DROP SCHEMA [test] CASCADE", s.schemaSQL)
+	s.execute(restoreSQL...)
+
+	// Once there are no more foreign keys the file is dropped
+	s.execute(`ALTER TABLE [test].T1 DROP CONSTRAINT T1_FK`)
+	s.execute(`ALTER TABLE [test].T2 DROP CONSTRAINT T2_FK`)
+	s.backup(Conf{DeferConstraints: true}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestRenameFunc() {
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0) PRIMARY KEY)`,
+		`CREATE OR REPLACE TABLE [test].T2 (B DECIMAL(18,0) CONSTRAINT T2_FK REFERENCES [test].T1 (A))`,
+	)
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."t1" (
+			"A" DECIMAL(18,0),
+			PRIMARY KEY ("A") ENABLE
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."t2" (
+			"B" DECIMAL(18,0),
+			CONSTRAINT "T2_FK" FOREIGN KEY ("B") REFERENCES "test"."t1" ("A") ENABLE
+		);
+	`
+	lowerTables := func(objType Object, schema, name string) (string, string) {
+		if objType == TABLES {
+			return schema, strings.ToLower(name)
+		}
+		return schema, name
+	}
+	// Backed up twice to check DropExtras keeps the renamed files
+	for i := 0; i < 2; i++ {
+		s.backup(Conf{RenameFunc: lowerTables, DropExtras: true}, TABLES)
+		s.expect(dt{
+			"schemas": dt{
+				"test": dt{
+					"tables": dt{
+						"t1.sql": table1SQL,
+						"t2.sql": table2SQL,
+					},
+				},
+			},
+		})
+	}
+}
+
+func (s *testSuite) TestTransformDDL() {
+	s.execute(`
+		CREATE OR REPLACE TABLE [test].T (
+			A DECIMAL(18,0) COMMENT IS 'column comment'
+		) COMMENT IS 'table comment'`,
+	)
+	commentRE := regexp.MustCompile(` COMMENT IS '(?:[^']|'')*'`)
+	var transformed []string
+	stripComments := func(objType Object, schema, name, ddl string) (string, error) {
+		s.Equal(TABLES, objType)
+		transformed = append(transformed, schema+"."+name)
+		return commentRE.ReplaceAllString(ddl, ""), nil
+	}
+	s.backup(Conf{TransformDDL: stripComments}, TABLES)
+	s.Equal([]string{"test.T"}, transformed)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T.sql": `
+						CREATE OR REPLACE TABLE "test"."T" (
+							"A" DECIMAL(18,0)
+						);
+					`,
+				},
+			},
+		},
+	})
+
+	failing := func(objType Object, schema, name, ddl string) (string, error) {
+		return "", fmt.Errorf("bad DDL")
+	}
+	err := Backup(Conf{
+		Source:       s.exaConn,
+		Destination:  s.testDir,
+		LogLevel:     s.loglevel,
+		Objects:      []Object{TABLES},
+		TransformDDL: failing,
+	})
+	s.EqualError(err, "Unable to transform DDL of test.T: bad DDL")
+}
+
+func (s *testSuite) TestSchemaBundle() {
+	table1SQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" DECIMAL(18,0),
+			CONSTRAINT "T1_PK" PRIMARY KEY ("A") ENABLE
+		);
+	`
+	table2SQL := `
+		CREATE OR REPLACE TABLE "test"."T2" (
+			"A" DECIMAL(18,0),
+			"B" DECIMAL(18,0),
+			CONSTRAINT "T2_PK" PRIMARY KEY ("A") ENABLE
+		);
+	`
+	fk1SQL := `ALTER TABLE "test"."T1" ADD CONSTRAINT "T1_FK" FOREIGN KEY ("B") REFERENCES "test"."T2" ("A") ENABLE;` + "\n"
+	fk2SQL := `ALTER TABLE "test"."T2" ADD CONSTRAINT "T2_FK" FOREIGN KEY ("B") REFERENCES "test"."T1" ("A") ENABLE;` + "\n"
+	s.execute(table1SQL, table2SQL, fk1SQL, fk2SQL)
+	s.backup(Conf{EmitSchemaBundle: true}, SCHEMAS, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"schema.sql":  s.schemaSQL,
+				"_schema.sql": s.schemaSQL + table1SQL + table2SQL + fk1SQL + fk2SQL,
+				"tables": dt{
+					"T1.sql": `
+						CREATE OR REPLACE TABLE "test"."T1" (
+							"A" DECIMAL(18,0),
+							"B" DECIMAL(18,0),
+							CONSTRAINT "T1_FK" FOREIGN KEY ("B") REFERENCES "test"."T2" ("A") ENABLE,
+							CONSTRAINT "T1_PK" PRIMARY KEY ("A") ENABLE
+						);
+					`,
+					"T2.sql": `
+						CREATE OR REPLACE TABLE "test"."T2" (
+							"A" DECIMAL(18,0),
+							"B" DECIMAL(18,0),
+							CONSTRAINT "T2_FK" FOREIGN KEY ("B") REFERENCES "test"."T1" ("A") ENABLE,
+							CONSTRAINT "T2_PK" PRIMARY KEY ("A") ENABLE
+						);
+					`,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestExportTimeZone() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" TIMESTAMP WITH LOCAL TIME ZONE
+		);
+	`
+	defer s.execute("ALTER SESSION SET TIME_ZONE = 'EUROPE/BERLIN'")
+	s.execute("ALTER SESSION SET TIME_ZONE = 'UTC'")
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES '2020-01-02 03:04:05.000'`)
+
+	// The connection's own time zone shouldn't matter
+	s.execute("ALTER SESSION SET TIME_ZONE = 'ASIA/TOKYO'")
+	s.backup(Conf{MaxTableRows: 100, ExportTimeZone: "UTC"}, TABLES)
+	s.expect(dt{
+		"session.sql": regexp.MustCompile(`EUROPE/BERLIN`).ReplaceAllString(
+			testSessionSQL, "UTC",
+		),
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "2020-01-02 03:04:05.000\n",
+				},
+			},
+		},
+	})
+
+	// Defaults to the database's time zone
+	s.execute("ALTER SESSION SET TIME_ZONE = 'ASIA/TOKYO'")
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "2020-01-02 04:04:05.000\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestViews() {
+	openSchemaSQL := "OPEN SCHEMA [test];\n"
+	view1SQL := `CREATE OR REPLACE FORCE VIEW "test"."V1"
+		  (c COMMENT IS 'column comment') AS
+			SELECT 'Hi Mom!!' AS col
+		  COMMENT IS 'view comment'`
+	view2SQL := `CREATE OR REPLACE FORCE VIEW "test"."V2" AS SELECT 1 c`
+	s.execute(openSchemaSQL, view1SQL, view2SQL)
+	s.backup(Conf{MaxViewRows: 0}, VIEWS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"views": dt{
+					"V1.sql": openSchemaSQL + view1SQL + ";\n",
+					"V2.sql": openSchemaSQL + view2SQL + ";\n",
+				},
+			},
+		},
+	})
+
+	// Test --max-view-rows
+	s.backup(Conf{MaxViewRows: 100}, VIEWS)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"views": dt{
+					"V1.sql": openSchemaSQL + view1SQL + ";\n",
+					"V1.csv": "\"Hi Mom!!\"\n",
+					"V2.sql": openSchemaSQL + view2SQL + ";\n",
+					"V2.csv": "1\n",
+				},
+			},
+		},
+	})
+
+	// Test --drop-extras
+	s.execute("DROP VIEW v2")
+	s.backup(Conf{DropExtras: true}, VIEWS)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"views": dt{
+					"V1.sql": openSchemaSQL + view1SQL + ";\n",
+					"V1.csv": "\"Hi Mom!!\"\n",
+				},
+			},
+		},
+	})
+
+	// Test renamed views
+	s.execute("RENAME VIEW v1 TO v3")
+	view3SQL := regexp.MustCompile("V1").ReplaceAllString(view1SQL, "V3")
+	s.backup(Conf{DropExtras: true}, VIEWS)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"views": dt{
+					"V3.sql": openSchemaSQL + view3SQL + ";\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestViewTextVerbatim() {
+	viewBody := "AS\n  SELECT   a,\n\t\t   b -- odd\n    FROM   [test].T1\n\n  WHERE  a  >  1"
+	s.execute(
+		`CREATE OR REPLACE TABLE [test].T1 (A DECIMAL(18,0), B DECIMAL(18,0))`,
+		"CREATE OR REPLACE VIEW [test].V1 "+viewBody,
+	)
+	s.backup(Conf{}, VIEWS)
+	// The file is compared byte for byte as s.expect normalizes whitespace
+	viewSQL, err := ioutil.ReadFile(filepath.Join(s.testDir, "schemas", "test", "views", "V1.sql"))
+	s.NoError(err)
+	s.Equal(
+		"OPEN SCHEMA [test];\nCREATE OR REPLACE FORCE VIEW \"test\".\"V1\" "+viewBody+";\n",
+		string(viewSQL),
+	)
+}
+
+func (s *testSuite) TestViewConnections() {
+	connSQL := "CREATE OR REPLACE CONNECTION CONN TO 'someplace' USER 'joe' IDENTIFIED BY '12345678';\n"
+	viewSQL := `CREATE OR REPLACE FORCE VIEW "test"."V1" AS SELECT * FROM (IMPORT FROM EXA AT CONN STATEMENT 'SELECT 1')`
+	s.execute("DROP CONNECTION IF EXISTS conn")
+	s.execute(connSQL, viewSQL)
+	s.backup(Conf{}, CONNECTIONS, VIEWS)
+	s.expect(dt{
+		"connections.sql": regexp.MustCompile(`'12345678'`).ReplaceAllString(connSQL, "********"),
+		"schemas": dt{
+			"test": dt{
+				"views": dt{
+					"V1.sql": "OPEN SCHEMA [test];\n" + viewSQL + ";\n",
+				},
+			},
+		},
+	})
+
+	views := []*view{
+		{schema: "test", name: "V1", text: viewSQL},
+		{schema: "test", name: "V2", text: `CREATE VIEW "test"."V2" AS SELECT * FROM (IMPORT FROM JDBC AT "other" STATEMENT 'SELECT 1' UNION ALL IMPORT FROM JDBC AT "other" STATEMENT 'SELECT 2')`},
+		{schema: "test", name: "V3", text: `CREATE VIEW "test"."V3" AS SELECT * FROM (IMPORT FROM EXA AT 'host:8563' USER 'u' IDENTIFIED BY 'p' STATEMENT 'SELECT 1')`},
+	}
+	missing := getMissingViewConnections(views, []string{"CONN"})
+	s.Len(missing, 1)
+	s.Equal("V2", missing[0].view.name)
+	s.Equal("other", missing[0].connection)
+	missing = getMissingViewConnections(views, nil)
+	s.Len(missing, 2)
+	s.Equal("CONN", missing[0].connection)
+}
+
+func (s *testSuite) TestViewColumnList() {
+	openSchemaSQL := "OPEN SCHEMA [test];\n"
+	viewSQL := `CREATE OR REPLACE FORCE VIEW "test"."V3"
+		  (a, "b" COMMENT IS 'middle column', c) AS
+			SELECT 1 AS x, 2 AS y, 3 AS z`
+	s.execute(openSchemaSQL, viewSQL)
+	s.backup(Conf{MaxViewRows: 100}, VIEWS)
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"views": dt{
+					"V3.sql": openSchemaSQL + viewSQL + ";\n",
+					"V3.csv": "1,2,3\n",
 				},
 			},
 		},
 	})
+}
 
-	// Test --max-view-rows
+func (s *testSuite) TestInvalidViews() {
+	openSchemaSQL := "OPEN SCHEMA [test];\n"
+	viewSQL := `CREATE OR REPLACE FORCE VIEW "test"."V1" AS SELECT * FROM "test"."T1"`
+	s.execute(
+		openSchemaSQL,
+		`CREATE TABLE T1 (A DECIMAL(18,0))`,
+		viewSQL,
+		`DROP TABLE T1`,
+	)
+	// The view's data can't be queried but its DDL is still backed up
 	s.backup(Conf{MaxViewRows: 100}, VIEWS)
 	s.expect(dt{
+		"session.sql": testSessionSQL,
 		"schemas": dt{
 			"test": dt{
 				"views": dt{
-					"V1.sql": openSchemaSQL + view1SQL + ";\n",
-					"V1.csv": "\"Hi Mom!!\"\n",
-					"V2.sql": openSchemaSQL + view2SQL + ";\n",
-					"V2.csv": "1\n",
+					"V1.sql": openSchemaSQL + viewSQL + ";\n",
 				},
 			},
 		},
 	})
 
-	// Test --drop-extras
-	s.execute("DROP VIEW v2")
-	s.backup(Conf{DropExtras: true}, VIEWS)
+	includeInvalid := false
+	s.backup(Conf{MaxViewRows: 100, IncludeInvalidViews: &includeInvalid, DropExtras: true}, VIEWS)
 	s.expect(dt{
+		"session.sql": testSessionSQL,
 		"schemas": dt{
 			"test": dt{
-				"views": dt{
-					"V1.sql": openSchemaSQL + view1SQL + ";\n",
-					"V1.csv": "\"Hi Mom!!\"\n",
-				},
+				"views": dt{},
 			},
 		},
 	})
+}
 
-	// Test renamed views
-	s.execute("RENAME VIEW v1 TO v3")
-	view3SQL := regexp.MustCompile("V1").ReplaceAllString(view1SQL, "V3")
-	s.backup(Conf{DropExtras: true}, VIEWS)
+func (s *testSuite) TestObjectTimeout() {
+	openSchemaSQL := "OPEN SCHEMA [test];\n"
+	view1SQL := `CREATE OR REPLACE FORCE VIEW "test"."V1" AS SELECT 1 c`
+	view2SQL := `CREATE OR REPLACE FORCE VIEW "test"."V2" AS SELECT 2 c`
+	s.execute(openSchemaSQL, view1SQL, view2SQL)
+
+	// Make V1's export slow i.e. run into the QUERY_TIMEOUT
+	queryErr := errors.New("Query terminated because timeout was reached.")
+	var timeouts []string
+	defer func(orig func(*exasol.Conn, string) *exasol.Rows) { streamQuery = orig }(streamQuery)
+	streamQuery = func(conn *exasol.Conn, exportSQL string) *exasol.Rows {
+		res, err := conn.FetchSlice(`
+			SELECT session_value FROM exa_parameters
+			WHERE parameter_name = 'QUERY_TIMEOUT'
+		`)
+		s.NoError(err)
+		timeouts = append(timeouts, res[0][0].(string))
+		if strings.Contains(exportSQL, "[V1]") {
+			return &exasol.Rows{Error: queryErr}
+		}
+		return conn.StreamQuery(exportSQL)
+	}
+	queryTimeout := func() string {
+		res, err := s.exaConn.FetchSlice(`
+			SELECT session_value FROM exa_parameters
+			WHERE parameter_name = 'QUERY_TIMEOUT'
+		`)
+		s.NoError(err)
+		return res[0][0].(string)
+	}
+
+	// The slow view's data is skipped but the rest is backed up
+	s.backup(Conf{MaxViewRows: 100, ObjectTimeout: 1500 * time.Millisecond}, VIEWS)
 	s.expect(dt{
+		"session.sql": testSessionSQL,
 		"schemas": dt{
 			"test": dt{
 				"views": dt{
-					"V3.sql": openSchemaSQL + view3SQL + ";\n",
+					"V1.sql": openSchemaSQL + view1SQL + ";\n",
+					"V2.sql": openSchemaSQL + view2SQL + ";\n",
+					"V2.csv": "2\n",
 				},
 			},
 		},
 	})
+	// The timeout is only in place for the data queries
+	s.Equal([]string{"2", "2"}, timeouts)
+	s.Equal("0", queryTimeout())
+
+	err := Backup(Conf{
+		Source:        s.exaConn,
+		Destination:   s.testDir,
+		LogLevel:      s.loglevel,
+		Objects:       []Object{VIEWS},
+		MaxViewRows:   100,
+		ObjectTimeout: time.Second,
+		StrictMode:    true,
+	})
+	s.Error(err)
+	s.Equal("0", queryTimeout())
+
+	// Other errors aren't mistaken for timeouts
+	queryErr = errors.New("Something else went wrong")
+	err = Backup(Conf{
+		Source:        s.exaConn,
+		Destination:   s.testDir,
+		LogLevel:      s.loglevel,
+		Objects:       []Object{VIEWS},
+		MaxViewRows:   100,
+		ObjectTimeout: time.Second,
+	})
+	s.Error(err)
+	s.Equal("0", queryTimeout())
 }
 
 func (s *testSuite) TestFunctions() {
@@ -404,6 +2930,70 @@ func (s *testSuite) TestFunctions() {
 	})
 }
 
+func (s *testSuite) TestScriptLanguages() {
+	res, err := s.exaConn.FetchSlice(`
+		SELECT system_value FROM exa_parameters
+		WHERE parameter_name = 'SCRIPT_LANGUAGES'
+	`)
+	s.NoError(err)
+	languages := res[0][0].(string)
+	s.execute(`ALTER SYSTEM SET SCRIPT_LANGUAGES='` + languages + ` MYPY=builtin_python3'`)
+	defer s.execute(`ALTER SYSTEM SET SCRIPT_LANGUAGES='` + languages + `'`)
+
+	udfSQL := `CREATE OR REPLACE MYPY SCALAR SCRIPT "UDF" () RETURNS DECIMAL(18,0) AS
+def run(ctx):
+	return 1
+`
+	s.execute("OPEN SCHEMA [test]", udfSQL)
+	s.backup(Conf{}, SCRIPTS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"scripts": dt{
+					"UDF.sql": "OPEN SCHEMA [test];\n--/\n" + udfSQL + "\n/\n",
+				},
+			},
+		},
+	})
+
+	scripts := []*script{
+		{schema: "test", name: "UDF", text: udfSQL},
+		{schema: "test", name: "LUA_UDF", text: `CREATE LUA SCALAR SCRIPT "LUA_UDF" () RETURNS DECIMAL(18,0) AS`},
+		{schema: "test", name: "PROC", text: `CREATE SCRIPT "PROC" AS`},
+		{schema: "test", name: "OTHER", text: `CREATE OR REPLACE other SET SCRIPT "OTHER" (a INT) EMITS (b INT) AS`},
+	}
+	s.Equal("MYPY", getScriptLanguage(udfSQL))
+	unregistered := getUnregisteredLanguages(scripts, languages+" MYPY=builtin_python3")
+	s.Len(unregistered, 1)
+	s.Equal("OTHER", unregistered[0].name)
+	s.Len(getUnregisteredLanguages(scripts, languages), 2)
+}
+
+func (s *testSuite) TestSignatures() {
+	openSchemaSQL := "OPEN SCHEMA [test];"
+	scriptSQL := `CREATE OR REPLACE PYTHON3 SCALAR SCRIPT "UDF3" ("A" DECIMAL(18,2), "B" VARCHAR(100) UTF8, "C" DATE) RETURNS VARCHAR(200) UTF8 AS
+def run(ctx):
+	return str(ctx.A) + ctx.B + str(ctx.C)
+	`
+	funcSQL := `CREATE OR REPLACE FUNCTION "test"."F3" (a DECIMAL(10,2), b VARCHAR(20))
+		RETURN VARCHAR(100) IS res VARCHAR(100); BEGIN res := b; RETURN res; END
+	`
+	s.execute(openSchemaSQL, scriptSQL, funcSQL)
+	s.backup(Conf{}, SCRIPTS, FUNCTIONS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"scripts": dt{
+					"UDF3.sql": openSchemaSQL + "\n--/\n" + scriptSQL + "\n/\n",
+				},
+				"functions": dt{
+					"F3.sql": openSchemaSQL + "\n--/\n" + funcSQL + "\n/\n",
+				},
+			},
+		},
+	})
+}
+
 func (s *testSuite) TestScripts() {
 	openSchemaSQL := "OPEN SCHEMA [test];"
 	script1SQL := `--/
@@ -453,6 +3043,139 @@ func (s *testSuite) TestScripts() {
 	})
 }
 
+func (s *testSuite) TestScriptKinds() {
+	openSchemaSQL := "OPEN SCHEMA [test];"
+	setSQL := `CREATE OR REPLACE LUA SET SCRIPT "SET_SCRIPT" ("A" DECIMAL(18,0)) EMITS ("B" DECIMAL(18,0)) AS
+		function run(ctx)
+			ctx.emit(ctx.A)
+		end
+	`
+	scalarSQL := `CREATE OR REPLACE LUA SCALAR SCRIPT "SCALAR_SCRIPT" ("A" VARCHAR(20) UTF8) RETURNS DECIMAL(10,2) AS
+		function run(ctx)
+			return 1.5
+		end
+	`
+	tableSQL := `CREATE OR REPLACE LUA SCRIPT "TABLE_SCRIPT" () RETURNS TABLE AS
+		return {{1}}, "a DECIMAL(18,0)"
+	`
+	s.execute(openSchemaSQL, setSQL, scalarSQL, tableSQL)
+	s.backup(Conf{}, SCRIPTS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"scripts": dt{
+					"SET_SCRIPT.sql":    openSchemaSQL + "\n--/\n" + setSQL + "\n/\n",
+					"SCALAR_SCRIPT.sql": openSchemaSQL + "\n--/\n" + scalarSQL + "\n/\n",
+					"TABLE_SCRIPT.sql":  openSchemaSQL + "\n--/\n" + tableSQL + "\n/\n",
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestAnalyzeImports() {
+	openSchemaSQL := "OPEN SCHEMA [test];"
+	scriptSQL := `CREATE OR REPLACE LUA SCRIPT "LOAD_ORDERS" () RETURNS ROWCOUNT AS
+		query([[IMPORT INTO "test"."ORDERS" FROM JDBC AT my_conn STATEMENT 'SELECT * FROM orders WHERE status = ''open''']])
+		query([[EXPORT "test"."ORDERS" INTO EXA AT "Remote" TABLE archive.orders]])
+	`
+	s.execute(openSchemaSQL, scriptSQL)
+	s.backup(Conf{AnalyzeImports: true}, SCRIPTS)
+	deps := `{
+			"test.LOAD_ORDERS": [
+				{
+					"operation": "IMPORT",
+					"type": "JDBC",
+					"connection": "MY_CONN",
+					"statement": "SELECT * FROM orders WHERE status = 'open'"
+				},
+				{
+					"operation": "EXPORT",
+					"type": "EXA",
+					"connection": "Remote",
+					"table": "archive.orders"
+				}
+			]
+		}`
+	s.expect(dt{
+		"external_dependencies.json": deps,
+		"schemas": dt{
+			"test": dt{
+				"scripts": dt{
+					"LOAD_ORDERS.sql": openSchemaSQL + "\n--/\n" + scriptSQL + "\n/\n",
+				},
+			},
+		},
+	})
+
+	// Python imports and IMPORT/EXPORT within comments
+	// or non-query strings aren't mistaken for SQL.
+	udfSQL := `CREATE OR REPLACE PYTHON3 SCALAR SCRIPT "PY_UDF" (a VARCHAR(100)) RETURNS VARCHAR(100) AS
+import json
+# EXPORT INTO CSV AT 'nowhere'
+def run(ctx):
+    return "IMPORT FROM EXA AT fake_conn TABLE t"
+`
+	luaSQL := `CREATE OR REPLACE LUA SCRIPT "NOT_LOADING" () RETURNS ROWCOUNT AS
+		-- query([[IMPORT FROM JDBC AT commented_conn STATEMENT 'x']])
+		local s = "IMPORT FROM EXA AT not_a_query TABLE t"
+		query([[SELECT 'EXPORT t INTO EXA AT quoted_conn TABLE t' FROM dual]])
+	`
+	s.execute(openSchemaSQL, udfSQL, luaSQL)
+	s.backup(Conf{AnalyzeImports: true}, SCRIPTS)
+	data, err := ioutil.ReadFile(filepath.Join(s.testDir, "external_dependencies.json"))
+	s.NoError(err)
+	s.JSONEq(deps, string(data))
+
+	// The scripts are keyed as they're backed up and
+	// those skipped by the ObjectFilter are left out.
+	s.execute(openSchemaSQL, strings.Replace(scriptSQL, "LOAD_ORDERS", "LOAD_MORE", 1))
+	s.backup(Conf{
+		AnalyzeImports: true,
+		NameCase:       LOWER_CASE,
+		ObjectFilter:   func(o DiscoveredObject) bool { return o.Name != "LOAD_MORE" },
+		RenameFunc: func(objType Object, schema, name string) (string, string) {
+			return "archive", name
+		},
+	}, SCRIPTS)
+	data, err = ioutil.ReadFile(filepath.Join(s.testDir, "external_dependencies.json"))
+	s.NoError(err)
+	s.JSONEq(strings.Replace(deps, `"test.LOAD_ORDERS"`, `"archive.load_orders"`, 1), string(data))
+}
+
+func (s *testSuite) TestRoleSuggestions() {
+	for _, u := range []string{"U1", "U2", "U3", "U4"} {
+		s.execute(
+			fmt.Sprintf(`CREATE USER %s IDENTIFIED BY "12345678"`, u),
+			fmt.Sprintf(`GRANT CREATE SESSION TO %s`, u),
+		)
+		if u != "U4" {
+			s.execute(fmt.Sprintf(`GRANT SELECT ON SCHEMA [test] TO %s`, u))
+		}
+	}
+	s.backup(Conf{NormalizePrivilegesToRoles: true}, USERS)
+	data, err := ioutil.ReadFile(filepath.Join(s.testDir, "role_suggestions.json"))
+	s.NoError(err)
+	s.JSONEq(`[
+		{
+			"role": "SHARED_ROLE_1",
+			"users": ["U1", "U2", "U3", "U4"],
+			"grants": ["CREATE SESSION"]
+		},
+		{
+			"role": "SHARED_ROLE_2",
+			"users": ["U1", "U2", "U3"],
+			"grants": ["SELECT ON SCHEMA [test]"]
+		}
+	]`, string(data))
+
+	// The users' own grants are left as they are
+	userSQL, err := ioutil.ReadFile(filepath.Join(s.testDir, "users", "U1.sql"))
+	s.NoError(err)
+	s.Contains(string(userSQL), "GRANT CREATE SESSION TO [U1];")
+	s.Contains(string(userSQL), "GRANT SELECT ON SCHEMA [test] TO [U1];")
+}
+
 func (s *testSuite) TestUsers() {
 	password := regexp.MustCompile(`"12345678"`)
 	user1SQL := "CREATE USER [JOE] IDENTIFIED BY \"12345678\";\n"
@@ -480,19 +3203,111 @@ func (s *testSuite) TestUsers() {
 	})
 }
 
+func (s *testSuite) TestUserPrincipals() {
+	user1SQL := "CREATE USER [JOHN] IDENTIFIED AT LDAP AS 'cn=john,ou=users,dc=example,dc=com'"
+	user2SQL := "CREATE USER [JIM] IDENTIFIED AT LDAP AS 'cn=O''Brien\\, Jim,ou=users,dc=example,dc=com'"
+	user3SQL := "CREATE USER [JANE] IDENTIFIED BY KERBEROS PRINCIPAL 'jane/admin@EXAMPLE.COM';\n"
+
+	s.execute("DROP USER IF EXISTS john")
+	s.execute("DROP USER IF EXISTS jim")
+	s.execute("DROP USER IF EXISTS jane")
+	s.execute(user1SQL+" FORCE", user2SQL+" FORCE", user3SQL)
+	s.backup(Conf{}, USERS)
+	s.expect(dt{
+		"users": dt{
+			"JOHN.sql": user1SQL + ";\n",
+			"JIM.sql":  user2SQL + ";\n",
+			"JANE.sql": user3SQL,
+		},
+	})
+}
+
+func (s *testSuite) TestSchemaOwner() {
+	userSQL := "CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe';\n"
+	ownerSQL := "ALTER SCHEMA [test] CHANGE OWNER [JOE];\n"
+	s.execute("DROP USER IF EXISTS joe")
+	s.execute(userSQL, ownerSQL)
+	s.backup(Conf{}, SCHEMAS, USERS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": s.schemaSQL +
+					"-- Owned by JOE. Applied with the owner's user/role once it exists:\n-- " + ownerSQL,
+			},
+		},
+		"users": dt{
+			"JOE.sql": userSQL + ownerSQL,
+		},
+	})
+
+	schemas := []*schema{
+		{name: "test", owner: "JOE"},
+		{name: "S2", owner: "SYS"},
+		{name: "S3", owner: "ANALYSTS"},
+	}
+	unowned := getUnownedSchemas(schemas, []string{"JOE"})
+	s.Len(unowned, 1)
+	s.Equal("S3", unowned[0].name)
+	s.Len(getUnownedSchemas(schemas, nil), 2)
+}
+
+func (s *testSuite) TestGroupRemap() {
+	userSQL := "CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe';\n"
+	groupSQL := "GRANT PRIORITY GROUP [%s] TO [JOE];\n"
+	if capability.consumerGroups {
+		groupSQL = "ALTER USER [JOE] SET CONSUMER_GROUP = [%s];\n"
+	}
+	s.execute("DROP USER IF EXISTS joe")
+	s.execute(userSQL, fmt.Sprintf(groupSQL, "HIGH"))
+
+	s.backup(Conf{GroupRemap: map[string]string{"HIGH": "MEDIUM"}}, USERS)
+	s.expect(dt{
+		"users": dt{
+			"JOE.sql": userSQL + fmt.Sprintf(groupSQL, "MEDIUM"),
+		},
+	})
+
+	s.backup(Conf{GroupRemap: map[string]string{"LOW": "MEDIUM"}, DropUnmappedGroups: true}, USERS)
+	s.expect(dt{
+		"users": dt{
+			"JOE.sql": userSQL,
+		},
+	})
+}
+
 func (s *testSuite) TestRoles() {
 	roleSQL := "CREATE ROLE [LUMBERJACKS];\n"
 	groupSQL := "ALTER ROLE [LUMBERJACKS] SET CONSUMER_GROUP = [LOW];\n"
 	commentSQL := "COMMENT ON ROLE [LUMBERJACKS] IS 'tough guys';\n"
+	plainRoleSQL := "CREATE ROLE [CHEFS];\n" // No consumer group
 
 	s.execute("DROP ROLE IF EXISTS lumberjacks")
-	s.execute(roleSQL, groupSQL, commentSQL)
+	s.execute("DROP ROLE IF EXISTS chefs")
+	s.execute(roleSQL, groupSQL, commentSQL, plainRoleSQL)
 	s.backup(Conf{}, ROLES)
 	s.expect(dt{
 		"roles": dt{
 			"DBA.sql":         "COMMENT ON ROLE [DBA] IS 'DBA stands for database administrator and has all possible privileges. This role should only be assigned to very few users because it provides these with full access to the database.';\n",
 			"PUBLIC.sql":      "COMMENT ON ROLE [PUBLIC] IS 'The PUBLIC role stands apart because every user receives this role automatically. This makes it very simple to grant and later withdraw certain privileges to/from all users of the database. However, this should only occur if one is quite sure that it is safe to grant the respective rights and the shared data should be publicly accessible.';\nGRANT USE ANY SCHEMA TO [PUBLIC];\n",
-			"LUMBERJACKS.sql": roleSQL + groupSQL + commentSQL,
+			"LUMBERJACKS.sql": roleSQL + commentSQL + groupSQL,
+			"CHEFS.sql":       plainRoleSQL,
+		},
+	})
+}
+
+func (s *testSuite) TestPublicRole() {
+	publicCommentSQL := "COMMENT ON ROLE [PUBLIC] IS 'The PUBLIC role stands apart because every user receives this role automatically. This makes it very simple to grant and later withdraw certain privileges to/from all users of the database. However, this should only occur if one is quite sure that it is safe to grant the respective rights and the shared data should be publicly accessible.';\n"
+	sql := []string{
+		"GRANT CREATE SESSION TO [PUBLIC]",          // System Priv
+		"GRANT USE ANY SCHEMA TO [PUBLIC]",          // Default System Priv
+		"GRANT SELECT ON SCHEMA [test] TO [PUBLIC]", // Object Priv
+	}
+	s.execute(sql[0], sql[2])
+	s.backup(Conf{}, ROLES)
+	s.expect(dt{
+		"roles": dt{
+			"DBA.sql":    "COMMENT ON ROLE [DBA] IS 'DBA stands for database administrator and has all possible privileges. This role should only be assigned to very few users because it provides these with full access to the database.';\n",
+			"PUBLIC.sql": publicCommentSQL + strings.Join(sql, ";\n") + ";\n",
 		},
 	})
 }
@@ -511,6 +3326,28 @@ func (s *testSuite) TestConnections() {
 	})
 }
 
+func (s *testSuite) TestConnectionsOrder() {
+	connSQL := []string{
+		"CREATE OR REPLACE CONNECTION ZED TO 'z' USER 'joe' IDENTIFIED BY 'x';\n",
+		"CREATE OR REPLACE CONNECTION ALPHA TO 'a' USER 'joe' IDENTIFIED BY 'x';\n",
+		"CREATE OR REPLACE CONNECTION MID TO 'm' USER 'joe' IDENTIFIED BY 'x';\n",
+	}
+	defer s.execute(
+		"DROP CONNECTION IF EXISTS zed",
+		"DROP CONNECTION IF EXISTS alpha",
+		"DROP CONNECTION IF EXISTS mid",
+	)
+	s.execute("DROP CONNECTION IF EXISTS conn")
+	s.execute(connSQL...)
+	s.backup(Conf{}, CONNECTIONS)
+	clean := func(sql string) string {
+		return regexp.MustCompile(`'x';`).ReplaceAllString(sql, "********;")
+	}
+	s.expect(dt{
+		"connections.sql": clean(connSQL[1]) + clean(connSQL[2]) + clean(connSQL[0]),
+	})
+}
+
 func (s *testSuite) TestEmptyConnections() {
 	connSQL := "CREATE OR REPLACE CONNECTION CONN TO '' USER '' IDENTIFIED BY '';\n"
 	cleanConnSQL := regexp.MustCompile(`'';`).ReplaceAllString(connSQL, "********;")
@@ -520,6 +3357,49 @@ func (s *testSuite) TestEmptyConnections() {
 	s.expect(dt{"connections.sql": cleanConnSQL})
 }
 
+func (s *testSuite) TestByScopeLayout() {
+	connSQL := "CREATE OR REPLACE CONNECTION CONN TO 'someplace' USER 'joe' IDENTIFIED BY '12345678';\n"
+	cleanConnSQL := regexp.MustCompile(`'12345678'`).ReplaceAllString(connSQL, "********")
+	user1SQL := "CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe';\n"
+	user2SQL := "CREATE USER [JANE] IDENTIFIED BY KERBEROS PRINCIPAL 'jane';\n"
+	s.execute("DROP CONNECTION IF EXISTS conn")
+	s.execute("DROP USER IF EXISTS joe")
+	s.execute("DROP USER IF EXISTS jane")
+	s.execute(connSQL, user1SQL, user2SQL)
+	s.backup(Conf{Layout: BY_SCOPE_LAYOUT}, SCHEMAS, CONNECTIONS, USERS)
+	s.expect(dt{
+		"global": dt{
+			"connections.sql": cleanConnSQL,
+			"users": dt{
+				"JOE.sql":  user1SQL,
+				"JANE.sql": user2SQL,
+			},
+		},
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": s.schemaSQL,
+			},
+		},
+	})
+
+	// DropExtras only affects the global/ tree
+	s.execute("DROP USER jane")
+	s.backup(Conf{Layout: BY_SCOPE_LAYOUT, DropExtras: true}, USERS)
+	s.expect(dt{
+		"global": dt{
+			"connections.sql": cleanConnSQL,
+			"users": dt{
+				"JOE.sql": user1SQL,
+			},
+		},
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": s.schemaSQL,
+			},
+		},
+	})
+}
+
 func (s *testSuite) TestConsumerGroups() {
 	if capability.consumerGroups {
 		groupSQL := []string{
@@ -599,23 +3479,47 @@ func (s *testSuite) TestConsumerGroups() {
 	}
 }
 
+func (s *testSuite) TestStrictMode() {
+	unsupported := PRIORITY_GROUPS
+	if !capability.consumerGroups {
+		unsupported = CONSUMER_GROUPS
+	}
+	conf := Conf{
+		Source:      s.exaConn,
+		Destination: s.testDir,
+		LogLevel:    s.loglevel,
+		Objects:     []Object{unsupported},
+	}
+	s.NoError(Backup(conf))
+
+	conf.StrictMode = true
+	s.Error(Backup(conf))
+}
+
 func (s *testSuite) TestPrivileges() {
 	prioritySQL := "GRANT PRIORITY GROUP [LOW] TO [JOE]"
 	if capability.consumerGroups {
 		prioritySQL = "ALTER USER [JOE] SET CONSUMER_GROUP = [LOW]"
 	}
+	// In the expected (grouped) order
 	sql := []string{
 		"CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe'",
-		prioritySQL, // Priority Priv
+		"GRANT [DBA] TO [JOE] WITH ADMIN OPTION",                             // Role Priv
+		"GRANT CREATE SESSION TO [JOE]",                                      // System Priv
+		"GRANT SELECT ANY TABLE TO [JOE] WITH ADMIN OPTION",                  // System Priv
+		"GRANT SELECT ON SCHEMA [test] TO [JOE]",                             // Object Priv
 		"GRANT CONNECTION CONN TO [JOE] WITH ADMIN OPTION",                   // Connection Priv
 		"GRANT ACCESS ON CONNECTION [CONN] FOR SCRIPT [test].[SCR] TO [JOE]", // Connection Restricted Priv
 		"GRANT ACCESS ON CONNECTION [CONN] FOR SCHEMA [test] TO [JOE]",       // Connection Restricted Priv
-		"GRANT SELECT ON SCHEMA [test] TO [JOE]",                             // Object Priv
-		"GRANT [DBA] TO [JOE] WITH ADMIN OPTION",                             // Role Priv
-		"GRANT SELECT ANY TABLE TO [JOE] WITH ADMIN OPTION",                  // System Priv
 		"GRANT IMPERSONATION ON [DBA] TO [JOE]",                              // Impersonation Priv
+		prioritySQL,                                                          // Priority Priv
 		"ALTER SCHEMA [test] CHANGE OWNER [JOE]",                             // Schema Owner
 	}
+	// Grant them in a jumbled order
+	grantSQL := []string{
+		sql[0], sql[9], sql[10], sql[8], sql[5], sql[3], sql[6],
+		sql[1], sql[4], sql[7], sql[2],
+	}
 	s.execute("DROP USER IF EXISTS joe")
 	s.execute("DROP CONNECTION IF EXISTS conn")
 	s.execute("CREATE CONNECTION conn TO 'someplace'")
@@ -625,7 +3529,7 @@ func (s *testSuite) TestPrivileges() {
 				ctx.emit(true)
 			end
 	`)
-	s.execute(sql...)
+	s.execute(grantSQL...)
 	s.backup(Conf{}, USERS)
 	s.expect(dt{
 		"users": dt{
@@ -634,6 +3538,117 @@ func (s *testSuite) TestPrivileges() {
 	})
 }
 
+func (s *testSuite) TestRestrictedConnectionPrivileges() {
+	userSQL := "CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe';\n"
+	plainSQL := "GRANT CONNECTION CONN TO [JOE];\n"
+	restrictedSQL := "GRANT ACCESS ON CONNECTION [CONN] FOR SCHEMA [test] TO [JOE];\n"
+	s.execute("DROP USER IF EXISTS joe")
+	s.execute("DROP CONNECTION IF EXISTS conn")
+	s.execute("CREATE CONNECTION conn TO 'someplace'")
+	s.execute(userSQL, restrictedSQL, plainSQL)
+	s.backup(Conf{}, USERS)
+	s.expect(dt{
+		"users": dt{
+			"JOE.sql": userSQL + plainSQL + restrictedSQL,
+		},
+	})
+}
+
+func (s *testSuite) TestSystemPrivileges() {
+	userSQL := "CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe';\n"
+	// Not privileges the code knows about in particular
+	killSQL := "GRANT KILL ANY SESSION TO [JOE];\n"
+	useSQL := "GRANT USE ANY CONNECTION TO [JOE] WITH ADMIN OPTION;\n"
+	s.execute("DROP USER IF EXISTS joe")
+	s.execute(userSQL, useSQL, killSQL)
+	s.backup(Conf{}, USERS)
+	s.expect(dt{
+		"users": dt{
+			"JOE.sql": userSQL + killSQL + useSQL,
+		},
+	})
+}
+
+func (s *testSuite) TestImpersonationPrivileges() {
+	joeSQL := "CREATE USER [JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe';\n"
+	janeSQL := "CREATE USER [JANE] IDENTIFIED BY KERBEROS PRINCIPAL 'jane';\n"
+	onUserSQL := "GRANT IMPERSONATION ON [JANE] TO [JOE];\n"
+	onRoleSQL := "GRANT IMPERSONATION ON [R1] TO [JOE];\n"
+	s.execute("DROP USER IF EXISTS joe")
+	s.execute("DROP USER IF EXISTS jane")
+	s.execute("DROP ROLE IF EXISTS r1")
+	s.execute(joeSQL, janeSQL, "CREATE ROLE R1", onRoleSQL, onUserSQL)
+	s.backup(Conf{}, USERS)
+	s.expect(dt{
+		"users": dt{
+			"JANE.sql": janeSQL,
+			"JOE.sql":  joeSQL + onUserSQL + onRoleSQL,
+		},
+	})
+}
+
+func (s *testSuite) TestSkipFailingObject() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL,
+		`CREATE OR REPLACE TABLE [test].T2 (A DECIMAL(18,0))`,
+		`INSERT INTO [test].T2 VALUES 1`,
+	)
+	conf := Conf{
+		Source:          s.exaConn,
+		Destination:     s.testDir,
+		LogLevel:        s.loglevel,
+		Objects:         []Object{TABLES},
+		MaxTableRows:    100,
+		DataExportHints: map[string]string{"test.T2": "BOOLEAN = 'BOGUS'"},
+	}
+	s.Error(Backup(conf))
+
+	// Once skipped the failing table is never even read
+	os.RemoveAll(filepath.Join(s.testDir, "schemas"))
+	conf.Skip = "test.T2"
+	s.NoError(Backup(conf))
+	s.expect(dt{
+		"session.sql": testSessionSQL,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+		"manifest.json": `
+			{
+				"data": {
+					"schemas/test/tables/T1.csv": {
+						"empty": true
+					}
+				}
+			}
+		`,
+	})
+}
+
+func (s *testSuite) TestSystemObjectCriteria() {
+	crit := getCriteria(Conf{Match: "*.*"})
+	s.False(crit.matches("EXA_STATISTICS", ""))
+	s.False(crit.matches("EXA_STATISTICS", "EXA_DB_SIZE_LAST_DAY"))
+	s.False(crit.matches("SYS", "EXA_SQL_KEYWORDS"))
+	s.True(crit.matches("test", "T1"))
+
+	crit = getCriteria(Conf{Match: "*.*", Skip: "test.T1"})
+	s.False(crit.matches("EXA_STATISTICS", "EXA_DB_SIZE_LAST_DAY"))
+	s.False(crit.matches("test", "T1"))
+	s.True(crit.matches("test", "T2"))
+
+	crit = getCriteria(Conf{Match: "*.*", IncludeSystemObjects: true})
+	s.True(crit.matches("EXA_STATISTICS", ""))
+	s.True(crit.matches("EXA_STATISTICS", "EXA_DB_SIZE_LAST_DAY"))
+}
+
 func (s *testSuite) TestCriteria() {
 	tests := [][]string{
 		// matchCriteria, skipCriteria, schemaToBeChecked, objectToBeChecked, expectedReturn
@@ -692,3 +3707,39 @@ func (s *testSuite) TestCriteria() {
 		s.Equal(exp, got)
 	}
 }
+
+// Run via: go test -run XXX -bench WriteTableData
+func BenchmarkWriteTableData(b *testing.B) {
+	run := newBackupRun()
+	initLogging(*testLoglevel)
+	dir, err := ioutil.TempDir(*testTmpdir, "exasol-bench-data-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Exasol streams the export in small chunks
+	chunk := []byte(strings.Repeat("12345,some text,2020-01-02 03:04:05.000\n", 100))
+	const numChunks = 25000 // ~100MB
+
+	for _, size := range []int{4096, defaultWriteBufferSize} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			defer func(orig int) { run.option.writeBufferSize = orig }(run.option.writeBufferSize)
+			run.option.writeBufferSize = size
+			b.SetBytes(int64(len(chunk) * numChunks))
+			for i := 0; i < b.N; i++ {
+				t := &table{name: "T", rowCount: 1, data: make(chan []byte, 100)}
+				go func() {
+					for j := 0; j < numChunks; j++ {
+						t.data <- chunk
+					}
+					close(t.data)
+				}()
+				err := run.writeTableData(dir, t, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
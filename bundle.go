@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// This collects the DDL of each schema's objects as they're backed up
+// so it can be written as a single _schema.sql per schema which can be
+// applied in one go.
+// The objects are ordered so that their intra-schema dependencies
+// are satisfied. All foreign keys are added after all the tables
+// so that tables referencing each other can be created.
+// Views are created with FORCE and scripts aren't validated on creation
+// so their order doesn't otherwise matter.
+
+var bundleSections = []string{
+	"schema",
+	"tables",
+	"constraints",
+	"functions",
+	"scripts",
+	"views",
+}
+
+type schemaBundles struct {
+	schemas map[string]map[string][]string // schema -> section -> SQL
+	mu      sync.Mutex
+	run     *backupRun
+}
+
+func (b *backupRun) newSchemaBundles() *schemaBundles {
+	return &schemaBundles{schemas: map[string]map[string][]string{}, run: b}
+}
+
+func (s *schemaBundles) add(schema, section, sql string) {
+	if s == nil || sql == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schemas[schema] == nil {
+		s.schemas[schema] = map[string][]string{}
+	}
+	s.schemas[schema][section] = append(s.schemas[schema][section], sql)
+}
+
+func (s *schemaBundles) write(dst string) error {
+	if s == nil {
+		return nil
+	}
+	log.Info("Backing up schema bundles")
+
+	var schemaNames []string
+	for schemaName := range s.schemas {
+		schemaNames = append(schemaNames, schemaName)
+	}
+	sort.Strings(schemaNames)
+
+	for _, schemaName := range schemaNames {
+		var sql []string
+		for _, section := range bundleSections {
+			sql = append(sql, s.schemas[schemaName][section]...)
+		}
+		dir := filepath.Join(dst, "schemas", s.run.fileName(schemaName))
+		os.MkdirAll(dir, os.ModePerm)
+		file := filepath.Join(dir, "_schema.sql")
+		err := s.run.writeFile(file, []byte(s.run.fileHeader(schemaName)+strings.Join(sql, "\n")))
+		if err != nil {
+			return fmt.Errorf("Unable to backup schema bundle %s: %s", schemaName, err)
+		}
+		s.run.fileWritten(file)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package backup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/transform"
+)
+
+// This writes a table's/view's data to its CSV file. With MaxRowsPerFile
+// the data is instead split into files of at most that many rows named
+// <name>.000.csv, <name>.001.csv, etc. A row only ends at the row
+// separator outside of a delimited value so a value spanning multiple
+// lines is never split across files. If the data starts with the column
+// names (per its DataExportHints) then they're repeated at the start of
+// every file and aren't counted as a row. Nothing replaces the previous
+// backup's data until the export is committed: with AtomicWrites the
+// files are written under temporary names which are only renamed into
+// place (and any of the previous backup's chunks no longer needed
+// removed) by Commit.
+
+type csvWriter struct {
+	csvFile    string
+	maxRows    int  // 0 if the data isn't split
+	rowEnd     byte // The last byte of the row separator
+	quote      byte // The column delimiter
+	quoted     bool // If values can be delimited
+	rows       int  // In the current file
+	inQuote    bool
+	header     []byte // The column names row
+	headerDone bool   // Set once the column names (if any) are read
+	fp         string // The file currently being written
+	f          *os.File
+	tr         *transform.Writer // Set if the data is transcoded
+	enc        *encryptWriter    // Set if the files are encrypted
+	w          *bufio.Writer
+	failed     bool // If a write failed
+	chunks     int
+	size       int
+	files      []string // The (final) files written so far
+	run        *backupRun
+}
+
+func (b *backupRun) newCSVWriter(csvFile string, format csvFormat) *csvWriter {
+	c := &csvWriter{
+		csvFile:    csvFile,
+		maxRows:    b.option.maxRowsPerFile,
+		rowEnd:     '\n',
+		headerDone: !format.columnNames,
+		run:        b,
+	}
+	if format.rowSeparator == "CR" {
+		c.rowEnd = '\r'
+	}
+	if len(format.columnDelimiter) == 1 && format.delimit != "NEVER" {
+		c.quote = format.columnDelimiter[0]
+		c.quoted = true
+	}
+	return c
+}
+
+func (c *csvWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if c.w == nil {
+			err := c.openFile()
+			if err != nil {
+				return n, err
+			}
+		}
+		i := len(p)
+		header := !c.headerDone
+		if c.maxRows > 0 || header {
+			// Find where the column names or the current
+			// file's last row end (if within p)
+			for i = 0; i < len(p); i++ {
+				if !c.endsRow(p[i]) {
+					continue
+				}
+				if header {
+					c.headerDone = true
+					i++
+					break
+				}
+				c.rows++
+				if c.rows == c.maxRows {
+					i++
+					break
+				}
+			}
+		}
+		written, err := c.w.Write(p[:i])
+		n += written
+		if header {
+			c.header = append(c.header, p[:written]...)
+		} else {
+			c.size += written
+		}
+		if err != nil {
+			c.failed = true
+			return n, err
+		}
+		p = p[i:]
+		if c.maxRows > 0 && c.rows == c.maxRows {
+			err = c.closeFile()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Returns if the byte ends a row i.e. it's the end
+// of the row separator outside of a delimited value
+func (c *csvWriter) endsRow(b byte) bool {
+	if c.quoted && b == c.quote {
+		c.inQuote = !c.inQuote
+		return false
+	}
+	return b == c.rowEnd && !c.inQuote
+}
+
+// Closes the last file and puts the files written in place of the previous
+// backup's. If there was no data at all then a single empty file is left.
+func (c *csvWriter) Commit() error {
+	if c.w == nil && c.chunks == 0 {
+		err := c.openFile()
+		if err != nil {
+			return err
+		}
+	}
+	if c.w != nil {
+		err := c.closeFile()
+		if err != nil {
+			return err
+		}
+	}
+	if c.failed {
+		return fmt.Errorf("Unable to write to file %s", c.fp)
+	}
+	keep := map[string]bool{}
+	for _, fp := range c.files {
+		if c.run.option.atomicWrites {
+			err := os.Rename(fp+tmpExt, fp)
+			if err != nil {
+				return err
+			}
+		}
+		keep[fp] = true
+	}
+	// Including any differently split (or encrypted) prior backup
+	for _, fp := range allDataFiles(c.csvFile) {
+		if !keep[fp] {
+			os.Remove(fp)
+		}
+	}
+	return nil
+}
+
+// Removes the files written so that the previous backup's data is kept.
+// (Without AtomicWrites any of its files written over are lost though.)
+func (c *csvWriter) Abort() {
+	if c.w != nil {
+		c.f.Close()
+		c.w = nil
+		c.f = nil
+		c.tr = nil
+		c.enc = nil
+	}
+	for _, fp := range c.files {
+		if c.run.option.atomicWrites {
+			fp += tmpExt
+		}
+		os.Remove(fp)
+	}
+	c.files = nil
+}
+
+func (c *csvWriter) openFile() error {
+	fp := c.csvFile
+	if c.maxRows > 0 {
+		fp = fmt.Sprintf("%s.%03d.csv", strings.TrimSuffix(c.csvFile, ".csv"), c.chunks)
+	}
+	fp = c.run.storedPath(fp)
+	c.fp = fp
+	if c.run.option.atomicWrites {
+		fp += tmpExt
+	}
+	f, err := os.Create(fp)
+	if err != nil {
+		return fmt.Errorf("Unable to create file %s: %s", fp, err)
+	}
+	c.f = f
+	var w io.Writer = f
+	if c.run.option.encrypt != nil {
+		c.enc, err = newEncryptWriter(f, c.run.option.encrypt)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("Unable to encrypt file %s: %s", fp, err)
+		}
+		w = c.enc
+	}
+	if c.run.option.outputEncoding != nil {
+		c.tr = c.run.option.outputEncoding.newWriter(w)
+		w = c.tr
+	}
+	c.w = bufio.NewWriterSize(w, c.run.option.writeBufferSize)
+	c.files = append(c.files, c.fp)
+	c.chunks++
+	c.rows = 0
+	if c.chunks > 1 && c.headerDone {
+		_, err = c.w.Write(c.header)
+		if err != nil {
+			c.failed = true
+			return fmt.Errorf("Unable to write to file %s: %s", fp, err)
+		}
+	}
+	return nil
+}
+
+func (c *csvWriter) closeFile() error {
+	err := c.w.Flush()
+	if err == nil && c.tr != nil {
+		err = c.tr.Close()
+	}
+	if err == nil && c.enc != nil {
+		err = c.enc.Close()
+	}
+	if err != nil {
+		c.failed = true
+	}
+	c.f.Close()
+	c.w = nil
+	c.f = nil
+	c.tr = nil
+	c.enc = nil
+	return err
+}
+
+// Returns the files a data file was written to
+func (b *backupRun) dataFiles(csvFile string) []string {
+	if b.option.maxRowsPerFile == 0 {
+		return []string{b.storedPath(csvFile)}
+	}
+	return b.dataChunks(csvFile)
+}
+
+func (b *backupRun) dataChunks(csvFile string) []string {
+	return globChunks(b.storedPath(csvFile))
+}
+
+func globChunks(csvFile string) []string {
+	ext := ".csv"
+	if strings.HasSuffix(csvFile, encryptedExt) {
+		ext += encryptedExt
+	}
+	chunks, _ := filepath.Glob(strings.TrimSuffix(csvFile, ext) + ".[0-9][0-9][0-9]*" + ext)
+	sort.Strings(chunks)
+	return chunks
+}
+
+// Returns every file of a data file whether split, encrypted or not
+func allDataFiles(csvFile string) []string {
+	files := []string{csvFile, csvFile + encryptedExt}
+	files = append(files, globChunks(csvFile)...)
+	return append(files, globChunks(csvFile+encryptedExt)...)
+}
+
+// Removes a data file along with any chunks of it
+func removeDataFiles(csvFile string) {
+	for _, fp := range allDataFiles(csvFile) {
+		os.Remove(fp)
+	}
+}
@@ -0,0 +1,216 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eddyueue/go-exasol-client"
+)
+
+// This backs up the schema, object and column comments
+// as machine-readable comments.json files (one per schema).
+// These are purely informational and aren't meant to be restored.
+
+type schemaComments struct {
+	Comment string                     `json:"comment,omitempty"`
+	Objects map[string]*objectComments `json:"objects"`
+}
+
+type objectComments struct {
+	Type    string            `json:"type"`
+	Comment string            `json:"comment,omitempty"`
+	Columns map[string]string `json:"columns,omitempty"`
+}
+
+func BackupCommentsJSON(src *exasol.Conn, dst string, crit Criteria) error {
+	return newBackupRun().backupCommentsJSON(src, dst, crit)
+}
+
+func (b *backupRun) backupCommentsJSON(src *exasol.Conn, dst string, crit Criteria) error {
+	log.Info("Backing up comments JSON")
+
+	schemas, err := b.getCommentsToBackup(src, crit)
+	if err != nil {
+		return err
+	}
+
+	for dstSchema, comments := range schemas {
+		buf := &bytes.Buffer{}
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(comments)
+		if err != nil {
+			return fmt.Errorf("Unable to encode comments for %s: %s", dstSchema, err)
+		}
+
+		dir := filepath.Join(dst, "schemas", b.fileName(dstSchema))
+		os.MkdirAll(dir, os.ModePerm)
+		file := filepath.Join(dir, "comments.json")
+		err = b.writeFile(file, buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("Unable to backup comments for %s: %s", dstSchema, err)
+		}
+		b.fileWritten(file)
+	}
+
+	log.Info("Done backing up comments JSON")
+	return nil
+}
+
+// The object types (as in exa_all_objects) which ObjectFilter/RenameFunc apply to
+var commentObjectTypes = map[string]Object{
+	"TABLE":    TABLES,
+	"VIEW":     VIEWS,
+	"SCRIPT":   SCRIPTS,
+	"FUNCTION": FUNCTIONS,
+}
+
+// Returns the comments keyed by the schema they're backed up under. Objects
+// skipped by ObjectFilter are left out and RenameFunc is applied just like
+// for the objects' DDL.
+func (b *backupRun) getCommentsToBackup(conn *exasol.Conn, crit Criteria) (map[string]*schemaComments, error) {
+	res, err := conn.FetchSlice(`
+		SELECT s.schema_name,
+			   schema_comment,
+			   schema_owner,
+			   raw_object_size
+		FROM exa_schemas AS s
+		LEFT JOIN exa_all_object_sizes AS os
+		  ON s.schema_name = os.object_name
+		 AND os.object_type = 'SCHEMA'
+		ORDER BY s.schema_name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get schema comments: %s", err)
+	}
+	schemas := map[string]*schemaComments{}
+	getSchema := func(dstSchema string) *schemaComments {
+		s, ok := schemas[dstSchema]
+		if !ok {
+			s = &schemaComments{Objects: map[string]*objectComments{}}
+			schemas[dstSchema] = s
+		}
+		return s
+	}
+	for _, row := range res {
+		schemaName := row[0].(string)
+		if !crit.matches(schemaName, "") {
+			continue
+		}
+		o := DiscoveredObject{Type: SCHEMAS, Schema: schemaName}
+		if row[2] != nil {
+			o.Owner = row[2].(string)
+		}
+		if row[3] != nil {
+			o.RawSize = int64(row[3].(float64))
+		}
+		if !b.isSelected(o) {
+			continue
+		}
+		dstSchema, _ := b.renamed(SCHEMAS, schemaName, "")
+		s := getSchema(dstSchema)
+		if row[1] != nil {
+			s.Comment = row[1].(string)
+		}
+	}
+
+	sql := fmt.Sprintf(`
+		SELECT o.root_name   AS s,
+			   o.object_name AS o,
+			   o.object_type,
+			   o.object_comment,
+			   o.owner,
+			   t.table_row_count,
+			   os.raw_object_size
+		FROM exa_all_objects AS o
+		LEFT JOIN exa_all_tables AS t
+		  ON o.object_type = 'TABLE'
+		 AND t.table_schema = o.root_name
+		 AND t.table_name = o.object_name
+		LEFT JOIN exa_all_object_sizes AS os
+		  ON o.object_type = 'TABLE'
+		 AND os.object_type = 'TABLE'
+		 AND os.root_name = o.root_name
+		 AND os.object_name = o.object_name
+		WHERE o.root_type = 'SCHEMA'
+		  AND (%s)
+		ORDER BY local.s, local.o
+		`, crit.getSQLCriteria(),
+	)
+	res, err = conn.FetchSlice(sql)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get object comments: %s", err)
+	}
+	type commented struct {
+		comments           *objectComments
+		dstSchema, dstName string
+	}
+	objects := map[string]*commented{}
+	for _, row := range res {
+		schemaName := row[0].(string)
+		objName := row[1].(string)
+		obj := &commented{
+			comments: &objectComments{
+				Type:    row[2].(string),
+				Columns: map[string]string{},
+			},
+			dstSchema: schemaName,
+			dstName:   objName,
+		}
+		if row[3] != nil {
+			obj.comments.Comment = row[3].(string)
+		}
+		if objType, ok := commentObjectTypes[obj.comments.Type]; ok {
+			o := DiscoveredObject{Type: objType, Schema: schemaName, Name: objName}
+			if row[4] != nil {
+				o.Owner = row[4].(string)
+			}
+			if row[5] != nil {
+				o.Rows = row[5].(float64)
+			}
+			if row[6] != nil {
+				o.RawSize = int64(row[6].(float64))
+			}
+			if !b.isSelected(o) {
+				continue
+			}
+			obj.dstSchema, obj.dstName = b.renamed(objType, schemaName, objName)
+		}
+		objects[schemaName+"."+objName] = obj
+		if obj.comments.Comment != "" {
+			getSchema(obj.dstSchema).Objects[obj.dstName] = obj.comments
+		}
+	}
+
+	sql = fmt.Sprintf(`
+		SELECT column_schema AS s,
+			   column_table  AS o,
+			   column_name,
+			   column_comment
+		FROM exa_all_columns
+		WHERE column_comment IS NOT NULL
+		  AND (%s)
+		ORDER BY local.s, local.o, column_ordinal_position
+		`, crit.getSQLCriteria(),
+	)
+	res, err = conn.FetchSlice(sql)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get column comments: %s", err)
+	}
+	for _, row := range res {
+		schemaName := row[0].(string)
+		objName := row[1].(string)
+		obj, ok := objects[schemaName+"."+objName]
+		if !ok {
+			continue
+		}
+		obj.comments.Columns[row[2].(string)] = row[3].(string)
+		getSchema(obj.dstSchema).Objects[obj.dstName] = obj.comments
+	}
+
+	return schemas, nil
+}
@@ -2,9 +2,9 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/eddyueue/go-exasol-client"
 )
@@ -19,6 +19,10 @@ type connection struct {
 }
 
 func BackupConnections(src *exasol.Conn, dst string) error {
+	return newBackupRun().backupConnections(src, dst)
+}
+
+func (b *backupRun) backupConnections(src *exasol.Conn, dst string) error {
 	log.Info("Backing up connections")
 
 	connections, err := getConnectionsToBackup(src)
@@ -29,6 +33,7 @@ func BackupConnections(src *exasol.Conn, dst string) error {
 		log.Warning("No connections found")
 		return nil
 	}
+	b.countObjects(CONNECTIONS, len(connections))
 
 	var sql string
 	for _, connection := range connections {
@@ -36,10 +41,11 @@ func BackupConnections(src *exasol.Conn, dst string) error {
 	}
 	os.MkdirAll(dst, os.ModePerm)
 	file := filepath.Join(dst, "connections.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = b.writeFile(file, []byte(b.fileHeader("connections")+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup connections: %s", err)
 	}
+	b.fileWritten(file)
 
 	log.Info("Done backing up connections")
 	return nil
@@ -72,6 +78,10 @@ func getConnectionsToBackup(conn *exasol.Conn) ([]*connection, error) {
 		}
 		connections = append(connections, c)
 	}
+	// Backstop the ORDER BY so the output is reproducible
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].name < connections[j].name
+	})
 	return connections, nil
 }
 
@@ -2,9 +2,9 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/eddyueue/go-exasol-client"
 )
@@ -25,6 +25,10 @@ type consumerGroup struct {
 }
 
 func BackupConsumerGroups(src *exasol.Conn, dst string) error {
+	return newBackupRun().backupConsumerGroups(src, dst)
+}
+
+func (b *backupRun) backupConsumerGroups(src *exasol.Conn, dst string) error {
 	log.Info("Backing up consumer groups")
 
 	consumerGroups, err := getConsumerGroupsToBackup(src)
@@ -35,18 +39,20 @@ func BackupConsumerGroups(src *exasol.Conn, dst string) error {
 		log.Warning("No consumer groups found")
 		return nil
 	}
+	b.countObjects(CONSUMER_GROUPS, len(consumerGroups))
 
 	var sql string
 	for _, consumerGroup := range consumerGroups {
-		sql += createConsumerGroup(consumerGroup)
+		sql += b.createConsumerGroup(consumerGroup)
 	}
 
 	os.MkdirAll(dst, os.ModePerm)
 	file := filepath.Join(dst, "consumer_groups.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = b.writeFile(file, []byte(b.fileHeader("consumer groups")+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup consumer groups: %s", err)
 	}
+	b.fileWritten(file)
 
 	// Drop the legacy priority groups file to avoid confusion.
 	// Depending on the Exasol version we have either consumer or priority groups.
@@ -113,18 +119,22 @@ func getConsumerGroupsToBackup(conn *exasol.Conn) ([]*consumerGroup, error) {
 		}
 		consumerGroups = append(consumerGroups, p)
 	}
+	// Backstop the ORDER BY so the output is reproducible
+	sort.Slice(consumerGroups, func(i, j int) bool {
+		return consumerGroups[i].name < consumerGroups[j].name
+	})
 	return consumerGroups, nil
 }
 
-func createConsumerGroup(p *consumerGroup) string {
+func (b *backupRun) createConsumerGroup(p *consumerGroup) string {
 	log.Infof("Backing up consumer group %s", p.name)
 	sql := ""
 	if p.name == "SYS_CONSUMER_GROUP" || p.isDefault {
-		sql = fmt.Sprintf("ALTER CONSUMER GROUP [%s] SET", p.name)
+		sql = fmt.Sprintf("ALTER CONSUMER GROUP %s SET", b.qb(p.name))
 	} else {
 		sql = fmt.Sprintf(
-			"DROP CONSUMER GROUP [%s];\nCREATE CONSUMER GROUP [%s] WITH",
-			p.name, p.name,
+			"DROP CONSUMER GROUP %s;\nCREATE CONSUMER GROUP %s WITH",
+			b.qb(p.name), b.qb(p.name),
 		)
 	}
 	limit := func(i int) string {
@@ -150,8 +160,8 @@ func createConsumerGroup(p *consumerGroup) string {
 	)
 	if p.comment != "" {
 		sql += fmt.Sprintf(
-			"COMMENT ON CONSUMER GROUP [%s] IS '%s';\n",
-			p.name, qStr(p.comment),
+			"COMMENT ON CONSUMER GROUP %s IS '%s';\n",
+			b.qb(p.name), qStr(p.comment),
 		)
 	}
 	return sql
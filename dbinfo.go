@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eddyueue/go-exasol-client"
+)
+
+// This backs up informational details about the source database
+// (product name/version and enabled script languages) so that
+// the target can be checked for compatibility before restoring.
+
+type databaseInfo struct {
+	Metadata        map[string]string `json:"metadata"`
+	ScriptLanguages string            `json:"script_languages,omitempty"`
+}
+
+func BackupDatabaseInfo(src *exasol.Conn, dst string) error {
+	return newBackupRun().backupDatabaseInfo(src, dst)
+}
+
+func (b *backupRun) backupDatabaseInfo(src *exasol.Conn, dst string) error {
+	log.Info("Backing up database info")
+
+	info := &databaseInfo{Metadata: map[string]string{}}
+	res, err := src.FetchSlice(`
+		SELECT param_name, param_value
+		FROM exa_metadata
+		ORDER BY param_name
+	`)
+	if err != nil {
+		// Not all versions expose this so it isn't fatal
+		log.Warningf("Unable to get database metadata: %s", err)
+	}
+	for _, row := range res {
+		if row[0] != nil && row[1] != nil {
+			info.Metadata[row[0].(string)] = fmt.Sprintf("%v", row[1])
+		}
+	}
+	res, err = src.FetchSlice(`
+		SELECT system_value
+		FROM exa_parameters
+		WHERE parameter_name = 'SCRIPT_LANGUAGES'
+	`)
+	if err != nil {
+		log.Warningf("Unable to get script languages: %s", err)
+	} else if len(res) > 0 && res[0][0] != nil {
+		info.ScriptLanguages = res[0][0].(string)
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode database info: %s", err)
+	}
+	os.MkdirAll(dst, os.ModePerm)
+	file := filepath.Join(dst, "database_info.json")
+	err = b.writeFile(file, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to backup database info: %s", err)
+	}
+	b.fileWritten(file)
+
+	log.Info("Done backing up database info")
+	return nil
+}
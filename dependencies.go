@@ -0,0 +1,261 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/eddyueue/go-exasol-client"
+)
+
+// This backs up an informational external_dependencies.json mapping
+// each script to the connections (and the external tables/statements)
+// it IMPORTs from or EXPORTs to. It's a best-effort scan of the SQL
+// string literals a scripting program passes to query()/pquery() so
+// dynamically built statements won't be picked up. UDF/adapter scripts
+// can't run SQL so they're skipped.
+// It isn't meant to be restored.
+
+type externalDependency struct {
+	Operation  string `json:"operation"`
+	Type       string `json:"type,omitempty"`
+	Connection string `json:"connection,omitempty"`
+	Address    string `json:"address,omitempty"`
+	Table      string `json:"table,omitempty"`
+	Statement  string `json:"statement,omitempty"`
+}
+
+var (
+	importExportRE = regexp.MustCompile(`(?is)\b(IMPORT|EXPORT)\b(.*?)(;|$)`)
+	ieTypeRE       = regexp.MustCompile(`(?is)\b(?:FROM|INTO)\s+(JDBC|EXA|ORA|LOCAL\s+CSV|LOCAL\s+FBV|CSV|FBV|SCRIPT)\b`)
+	ieAtRE         = regexp.MustCompile(`(?is)\bAT\s+("[^"]+"|'(?:[^']|'')*'|[\w.$]+)`)
+	ieTableRE      = regexp.MustCompile(`(?is)^\s*TABLE\s+((?:"[^"]+"|[\w$]+)(?:\.(?:"[^"]+"|[\w$]+))?)`)
+	ieStatementRE  = regexp.MustCompile(`(?is)^\s*STATEMENT\s+'((?:[^']|'')*)'`)
+	spacesRE       = regexp.MustCompile(`\s+`)
+	luaQueryRE     = regexp.MustCompile(`\bp?query\s*\(?\s*$`)
+)
+
+func BackupExternalDependencies(src *exasol.Conn, dst string, crit Criteria) error {
+	return newBackupRun().backupExternalDependencies(src, dst, crit)
+}
+
+func (b *backupRun) backupExternalDependencies(src *exasol.Conn, dst string, crit Criteria) error {
+	log.Info("Backing up external dependencies")
+
+	scripts, _, err := getScriptsToBackup(src, crit)
+	if err != nil {
+		return err
+	}
+	// Keyed by the scripts' names as backed up so they match the files
+	deps := map[string][]*externalDependency{}
+	for _, s := range scripts {
+		if !b.isSelected(s.discovered()) {
+			continue
+		}
+		d := getScriptDependencies(s.text)
+		if len(d) > 0 {
+			schema, name := s.dst(b)
+			deps[b.fileName(schema)+"."+b.fileName(name)] = d
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(deps)
+	if err != nil {
+		return fmt.Errorf("Unable to encode external dependencies: %s", err)
+	}
+	os.MkdirAll(dst, os.ModePerm)
+	file := filepath.Join(dst, "external_dependencies.json")
+	err = b.writeFile(file, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Unable to backup external dependencies: %s", err)
+	}
+	b.fileWritten(file)
+
+	log.Info("Done backing up external dependencies")
+	return nil
+}
+
+// Returns the external dependencies of the SQL a script runs
+func getScriptDependencies(text string) []*externalDependency {
+	if getScriptLanguage(text) != "" {
+		return nil // A UDF/adapter script e.g. Python's "import"
+	}
+	var deps []*externalDependency
+	for _, sql := range getScriptQueries(text) {
+		deps = append(deps, getExternalDependencies(sql)...)
+	}
+	return deps
+}
+
+// Returns the string literals a Lua scripting program passes
+// to query()/pquery(). Comments and other strings are skipped.
+func getScriptQueries(text string) []string {
+	var queries []string
+	var code []byte // The text outside of comments and strings
+	for i := 0; i < len(text); {
+		var str string
+		switch {
+		case strings.HasPrefix(text[i:], "--"):
+			if _, end, ok := luaLongString(text, i+2); ok {
+				i = end
+			} else if nl := strings.IndexByte(text[i:], '\n'); nl >= 0 {
+				i += nl
+			} else {
+				i = len(text)
+			}
+			continue
+		case text[i] == '\'' || text[i] == '"':
+			str, i = luaQuotedString(text, i)
+		case text[i] == '[':
+			var ok bool
+			str, i, ok = luaLongString(text, i)
+			if !ok {
+				code = append(code, '[')
+				i++
+				continue
+			}
+		default:
+			code = append(code, text[i])
+			i++
+			continue
+		}
+		tail := code
+		if len(tail) > 64 {
+			tail = tail[len(tail)-64:]
+		}
+		if luaQueryRE.Match(tail) {
+			queries = append(queries, str)
+		}
+		code = append(code, `""`...)
+	}
+	return queries
+}
+
+// Returns the contents of the Lua long bracket string (e.g. [[...]]
+// or [==[...]==]) starting at i and the position after it.
+func luaLongString(text string, i int) (string, int, bool) {
+	if i >= len(text) || text[i] != '[' {
+		return "", i, false
+	}
+	j := i + 1
+	for j < len(text) && text[j] == '=' {
+		j++
+	}
+	if j >= len(text) || text[j] != '[' {
+		return "", i, false
+	}
+	closing := "]" + strings.Repeat("=", j-i-1) + "]"
+	start := j + 1
+	end := strings.Index(text[start:], closing)
+	if end < 0 {
+		return text[start:], len(text), true
+	}
+	return text[start : start+end], start + end + len(closing), true
+}
+
+// Returns the (unescaped) contents of the Lua quoted
+// string starting at i and the position after it.
+func luaQuotedString(text string, i int) (string, int) {
+	quote := text[i]
+	var str []byte
+	for i++; i < len(text); i++ {
+		switch text[i] {
+		case quote:
+			return string(str), i + 1
+		case '\n':
+			return string(str), i // Unterminated
+		case '\\':
+			i++
+			if i < len(text) {
+				if text[i] == 'n' {
+					str = append(str, '\n')
+				} else {
+					str = append(str, text[i])
+				}
+			}
+		default:
+			str = append(str, text[i])
+		}
+	}
+	return string(str), i
+}
+
+// Blanks out the comments and the contents of the string literals and
+// quoted identifiers of the SQL (keeping everything else in place) so
+// that keywords are only matched in the SQL itself.
+func maskSQL(sql string) string {
+	b := []byte(sql)
+	for i := 0; i < len(b); i++ {
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			for ; i < len(b) && b[i] != '\n'; i++ {
+				b[i] = ' '
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := len(b)
+			if n := strings.Index(sql[i+2:], "*/"); n >= 0 {
+				end = i + 2 + n + 2
+			}
+			for ; i < end; i++ {
+				b[i] = ' '
+			}
+			i--
+		case b[i] == '\'' || b[i] == '"':
+			quote := b[i]
+			for i++; i < len(b); i++ {
+				if b[i] == quote {
+					if i+1 < len(b) && b[i+1] == quote {
+						b[i], b[i+1] = 'x', 'x'
+						i++
+						continue
+					}
+					break
+				}
+				b[i] = 'x'
+			}
+		}
+	}
+	return string(b)
+}
+
+// Returns the IMPORT/EXPORT ... AT statements of the SQL
+func getExternalDependencies(sql string) []*externalDependency {
+	var deps []*externalDependency
+	masked := maskSQL(sql)
+	for _, m := range importExportRE.FindAllStringSubmatchIndex(masked, -1) {
+		body, maskedBody := sql[m[4]:m[5]], masked[m[4]:m[5]]
+		at := ieAtRE.FindStringSubmatchIndex(maskedBody)
+		if at == nil {
+			continue // Not an IMPORT/EXPORT from/to an external system
+		}
+		d := &externalDependency{Operation: strings.ToUpper(sql[m[2]:m[3]])}
+		if t := ieTypeRE.FindStringSubmatch(maskedBody); t != nil {
+			d.Type = strings.ToUpper(spacesRE.ReplaceAllString(t[1], " "))
+		}
+		target := body[at[2]:at[3]]
+		switch {
+		case strings.HasPrefix(target, "'"):
+			d.Address = strings.Replace(target[1:len(target)-1], "''", "'", -1)
+		case strings.HasPrefix(target, `"`):
+			d.Connection = target[1 : len(target)-1]
+		default:
+			d.Connection = strings.ToUpper(target)
+		}
+		rest, maskedRest := body[at[1]:], maskedBody[at[1]:]
+		if t := ieTableRE.FindStringSubmatchIndex(maskedRest); t != nil {
+			d.Table = rest[t[2]:t[3]]
+		} else if t := ieStatementRE.FindStringSubmatchIndex(maskedRest); t != nil {
+			d.Statement = strings.Replace(rest[t[2]:t[3]], "''", "'", -1)
+		}
+		deps = append(deps, d)
+	}
+	return deps
+}
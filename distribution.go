@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eddyueue/go-exasol-client"
+)
+
+// This backs up an informational distribution_stats.json recording how
+// evenly the rows of each table with a DISTRIBUTE BY key are spread
+// across the cluster's nodes, e.g. for rebalancing decisions before a
+// restore. It isn't meant to be restored.
+
+type distributionStats struct {
+	Schema      string  `json:"schema"`
+	Table       string  `json:"table"`
+	RowsPerNode []int64 `json:"rows_per_node"`
+	// The largest node's rows relative to the average (1 is even)
+	Skew float64 `json:"skew"`
+}
+
+func BackupDistributionStats(src *exasol.Conn, dst string, crit Criteria) error {
+	return newBackupRun().backupDistributionStats(src, dst, crit)
+}
+
+func (b *backupRun) backupDistributionStats(src *exasol.Conn, dst string, crit Criteria) error {
+	log.Info("Backing up distribution stats")
+
+	tables, _, err := getTablesToBackup(src, crit)
+	if err != nil {
+		return err
+	}
+	res, err := src.FetchSlice("SELECT NPROC()")
+	if err != nil {
+		return fmt.Errorf("Unable to get the number of nodes: %s", err)
+	}
+	nodes := int(res[0][0].(float64))
+
+	stats := []*distributionStats{}
+	for _, t := range tables {
+		if len(t.distribution) == 0 || !b.isSelected(t.discovered()) {
+			continue
+		}
+		s, err := getDistributionStats(src, t, nodes)
+		if err != nil {
+			// e.g. the table was dropped in the meantime
+			log.Warningf("Unable to get distribution stats of %s.%s: %s", t.schema, t.name, err)
+			continue
+		}
+		stats = append(stats, s)
+	}
+
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode distribution stats: %s", err)
+	}
+	os.MkdirAll(dst, os.ModePerm)
+	file := filepath.Join(dst, "distribution_stats.json")
+	err = b.writeFile(file, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to backup distribution stats: %s", err)
+	}
+	b.fileWritten(file)
+
+	log.Info("Done backing up distribution stats")
+	return nil
+}
+
+func getDistributionStats(conn *exasol.Conn, t *table, nodes int) (*distributionStats, error) {
+	res, err := conn.FetchSlice(fmt.Sprintf(
+		"SELECT IPROC(), COUNT(*) FROM %s.%s GROUP BY IPROC()",
+		bracket(t.schema), bracket(t.name),
+	))
+	if err != nil {
+		return nil, err
+	}
+	s := &distributionStats{
+		Schema:      t.schema,
+		Table:       t.name,
+		RowsPerNode: make([]int64, nodes),
+	}
+	var total, max int64
+	for _, row := range res {
+		node := int(row[0].(float64))
+		rows := int64(row[1].(float64))
+		if node < nodes {
+			s.RowsPerNode[node] = rows
+		}
+		total += rows
+		if rows > max {
+			max = rows
+		}
+	}
+	if total > 0 {
+		s.Skew = float64(max) / (float64(total) / float64(nodes))
+	}
+	return s, nil
+}
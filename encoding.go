@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+)
+
+// This transcodes the table/view data files from the UTF-8 exported by
+// Exasol into the OutputEncoding as they're written. What happens to
+// characters which can't be represented in the encoding is controlled by
+// the EncodingErrorMode. The DDL files are always left as UTF-8.
+
+type EncodingErrorMode byte
+
+const (
+	ENCODING_ERROR   EncodingErrorMode = iota // Fail the object's data export
+	ENCODING_REPLACE                          // Write the encoding's replacement character
+	ENCODING_SKIP                             // Leave the character out
+)
+
+// Exasol's names for encodings which aren't IANA names
+var exasolEncodings = map[string]string{
+	"UTF8":  "UTF-8",
+	"ASCII": "US-ASCII",
+}
+
+type outputEncoding struct {
+	name string // The encoding's canonical name
+	enc  encoding.Encoding
+	mode EncodingErrorMode
+}
+
+// Returns nil if the data is left as UTF-8
+func getOutputEncoding(name string, mode EncodingErrorMode) (*outputEncoding, error) {
+	if mode > ENCODING_SKIP {
+		return nil, fmt.Errorf("Invalid EncodingErrorMode %d", mode)
+	}
+	if alias, ok := exasolEncodings[strings.ToUpper(name)]; ok {
+		name = alias
+	}
+	if name == "" || strings.EqualFold(name, "UTF-8") {
+		return nil, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("Unsupported OutputEncoding %s", name)
+	}
+	canonical, err := ianaindex.MIME.Name(enc)
+	if err != nil {
+		canonical, err = ianaindex.IANA.Name(enc)
+		if err != nil {
+			canonical = name
+		}
+	}
+	return &outputEncoding{name: canonical, enc: enc, mode: mode}, nil
+}
+
+func (o *outputEncoding) newWriter(w io.Writer) *transform.Writer {
+	var t transform.Transformer
+	switch o.mode {
+	case ENCODING_REPLACE:
+		t = encoding.ReplaceUnsupported(o.enc.NewEncoder())
+	case ENCODING_SKIP:
+		t = transform.Chain(runes.Remove(runes.Predicate(o.unsupported())), o.enc.NewEncoder())
+	default:
+		t = o.enc.NewEncoder()
+	}
+	return transform.NewWriter(w, t)
+}
+
+// Returns a predicate for the characters the encoding can't represent
+func (o *outputEncoding) unsupported() func(rune) bool {
+	// The data's mostly the same few characters so remember the answer
+	seen := map[rune]bool{}
+	return func(r rune) bool {
+		u, ok := seen[r]
+		if !ok {
+			_, err := o.enc.NewEncoder().String(string(r))
+			u = err != nil
+			seen[r] = u
+		}
+		return u
+	}
+}
@@ -0,0 +1,325 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This encrypts the backed up files at rest as they're written so that
+// no plaintext ever reaches the Destination, even if the backup fails.
+// Each file is stored as a <file>.enc which starts with a header line
+// naming the algorithm followed by a random nonce prefix. The contents
+// are then sealed in segments so that files of any size can be streamed.
+// Each segment's nonce is the prefix, the segment number and whether
+// it's the last segment so segments can't be reordered, dropped or
+// truncated without the decryption failing.
+
+const (
+	encryptedExt       = ".enc"
+	encryptedAlgorithm = "AES-256-GCM-STREAM"
+	encryptedHeader    = "EXASOL-BACKUP " + encryptedAlgorithm + "\n"
+	encryptedSegment   = 64 * 1024 // Plaintext bytes per segment
+	noncePrefixSize    = 7
+)
+
+type EncryptConfig struct {
+	// The 32 byte AES-256 key
+	Key []byte
+	// Alternatively to Key a KeyFunc can be specified
+	// e.g. to fetch the key from a KMS
+	KeyFunc func() ([]byte, error)
+}
+
+func (e *EncryptConfig) getAEAD() (cipher.AEAD, error) {
+	key := e.Key
+	if e.KeyFunc != nil {
+		var err error
+		key, err = e.KeyFunc()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get encryption key: %s", err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("The encryption key must be 32 bytes not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the path a file is stored at i.e. with
+// the .enc extension if the backup is encrypted.
+func (b *backupRun) storedPath(fp string) string {
+	if b.option.encrypt == nil || strings.HasSuffix(fp, encryptedExt) {
+		return fp
+	}
+	return fp + encryptedExt
+}
+
+func segmentNonce(nonce []byte, counter uint32, last bool) []byte {
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	sealed  []byte
+}
+
+func newEncryptWriter(w io.Writer, aead cipher.AEAD) (*encryptWriter, error) {
+	e := &encryptWriter{
+		w:      w,
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, encryptedSegment),
+		sealed: make([]byte, 0, encryptedSegment+aead.Overhead()),
+	}
+	_, err := rand.Read(e.nonce[:noncePrefixSize])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	_, err = w.Write(append([]byte(encryptedHeader), e.nonce[:noncePrefixSize]...))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data follows
+		// since the last segment has to be sealed as such.
+		if len(e.buf) == encryptedSegment {
+			err := e.seal(false)
+			if err != nil {
+				return n, err
+			}
+		}
+		i := copy(e.buf[len(e.buf):encryptedSegment], p)
+		e.buf = e.buf[:len(e.buf)+i]
+		p = p[i:]
+		n += i
+	}
+	return n, nil
+}
+
+// Seals the last segment. It doesn't close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return fmt.Errorf("Too much data to encrypt")
+	}
+	nonce := segmentNonce(e.nonce, e.counter, last)
+	e.sealed = e.aead.Seal(e.sealed[:0], nonce, e.buf, []byte(encryptedHeader))
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+// Returns the file's contents encrypted
+func encrypt(aead cipher.AEAD, data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	e, err := newEncryptWriter(buf, aead)
+	if err != nil {
+		return nil, err
+	}
+	_, err = e.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = e.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	sealed  []byte
+	buf     []byte
+	done    bool
+}
+
+func newDecryptReader(r io.Reader, aead cipher.AEAD) (*decryptReader, error) {
+	d := &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		sealed: make([]byte, encryptedSegment+aead.Overhead()),
+	}
+	header := make([]byte, len(encryptedHeader)+noncePrefixSize)
+	_, err := io.ReadFull(d.r, header)
+	if err != nil || string(header[:len(encryptedHeader)]) != encryptedHeader {
+		return nil, fmt.Errorf("Not an encrypted backup file")
+	}
+	copy(d.nonce, header[len(encryptedHeader):])
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		err := d.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		_, err = d.r.Peek(1)
+		last = err == io.EOF
+	}
+	nonce := segmentNonce(d.nonce, d.counter, last)
+	d.buf, err = d.aead.Open(d.buf[:0], nonce, d.sealed[:n], []byte(encryptedHeader))
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt: %s", err)
+	}
+	d.counter++
+	d.done = last
+	return nil
+}
+
+// OpenBackupFile opens a backed up file for reading. If the backup was
+// taken with Conf.Encrypt (i.e. there's a <file>.enc) then it's
+// transparently decrypted with the EncryptConfig.
+func OpenBackupFile(fp string, e *EncryptConfig) (io.ReadCloser, error) {
+	f, err := os.Open(fp)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) || e == nil {
+		return nil, err
+	}
+	aead, err := e.getAEAD()
+	if err != nil {
+		return nil, err
+	}
+	return openEncryptedFile(fp+encryptedExt, aead)
+}
+
+type decryptFile struct {
+	io.Reader
+	io.Closer
+}
+
+func openEncryptedFile(fp string, aead cipher.AEAD) (io.ReadCloser, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDecryptReader(f, aead)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to read file %s: %s", fp, err)
+	}
+	return decryptFile{d, f}, nil
+}
+
+// Reads a file backed up by this run (decrypting it if need be)
+func (b *backupRun) readBackupFile(fp string) ([]byte, error) {
+	if b.option.encrypt == nil {
+		return ioutil.ReadFile(fp)
+	}
+	f, err := openEncryptedFile(b.storedPath(fp), b.option.encrypt)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// DecryptBackup decrypts the .enc files of a backup (in place)
+// which was taken with Conf.Encrypt so it can be restored.
+func DecryptBackup(dir string, e *EncryptConfig) error {
+	return newBackupRun().decryptBackup(dir, e)
+}
+
+func (b *backupRun) decryptBackup(dir string, e *EncryptConfig) error {
+	aead, err := e.getAEAD()
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(fp, encryptedExt) {
+			return nil
+		}
+		return decryptBackupFile(aead, fp)
+	})
+	if err != nil {
+		return err
+	}
+	return b.removeManifestEncryption(dir)
+}
+
+func decryptBackupFile(aead cipher.AEAD, fp string) error {
+	in, err := openEncryptedFile(fp, aead)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out := strings.TrimSuffix(fp, encryptedExt)
+	f, err := os.Create(out + tmpExt)
+	if err != nil {
+		return fmt.Errorf("Unable to create file %s: %s", out+tmpExt, err)
+	}
+	w := bufio.NewWriter(f)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
+	if err != nil {
+		// Never leave a partially decrypted file behind
+		os.Remove(out + tmpExt)
+		return fmt.Errorf("Unable to decrypt file %s: %s", fp, err)
+	}
+	err = os.Rename(out+tmpExt, out)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fp)
+}
@@ -2,10 +2,11 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/eddyueue/go-exasol-client"
 )
@@ -15,12 +16,20 @@ type function struct {
 	name    string
 	text    string
 	comment string
+	owner   string
 }
 
 func (f *function) Schema() string { return f.schema }
 func (f *function) Name() string   { return f.name }
 
+// The schema and name the function is backed up as
+func (f *function) dst(b *backupRun) (string, string) { return b.renamed(FUNCTIONS, f.schema, f.name) }
+
 func BackupFunctions(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
+	return newBackupRun().backupFunctions(src, dst, crit, dropExtras)
+}
+
+func (b *backupRun) backupFunctions(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Info("Backing up functions")
 
 	allFuncs, dbObjs, err := getFunctionsToBackup(src, crit)
@@ -28,18 +37,30 @@ func BackupFunctions(src *exasol.Conn, dst string, crit Criteria, dropExtras boo
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("functions", dbObjs, dst, crit)
+		b.removeExtraObjects(FUNCTIONS, dbObjs, dst, crit)
 	}
+	var selected []*function
+	for _, f := range allFuncs {
+		if b.isSelected(f.discovered()) {
+			selected = append(selected, f)
+		}
+	}
+	allFuncs = selected
 
 	if len(allFuncs) == 0 {
 		log.Warning("Object criteria did not match any functions")
 		return nil
 	}
+	b.countObjects(FUNCTIONS, len(allFuncs))
+	sort.SliceStable(allFuncs, func(i, j int) bool {
+		return b.schemaRank(allFuncs[i].schema) < b.schemaRank(allFuncs[j].schema)
+	})
 
 	for _, f := range allFuncs {
-		dir := filepath.Join(dst, "schemas", f.schema, "functions")
+		schema, _ := f.dst(b)
+		dir := filepath.Join(dst, "schemas", b.fileName(schema), "functions")
 		os.MkdirAll(dir, os.ModePerm)
-		err = createFunction(dir, f)
+		err = b.createFunction(dir, f)
 		if err != nil {
 			return err
 		}
@@ -48,12 +69,17 @@ func BackupFunctions(src *exasol.Conn, dst string, crit Criteria, dropExtras boo
 	return nil
 }
 
+func (f *function) discovered() DiscoveredObject {
+	return DiscoveredObject{Type: FUNCTIONS, Schema: f.schema, Name: f.name, Owner: f.owner}
+}
+
 func getFunctionsToBackup(conn *exasol.Conn, crit Criteria) ([]*function, []dbObj, error) {
 	sql := fmt.Sprintf(`
 		SELECT function_schema AS s,
 			   function_name   AS o,
 			   function_text,
-			   function_comment
+			   function_comment,
+			   function_owner
 		FROM exa_all_functions
 		WHERE %s
 		ORDER BY local.s, local.o
@@ -74,29 +100,43 @@ func getFunctionsToBackup(conn *exasol.Conn, crit Criteria) ([]*function, []dbOb
 		if row[3] != nil {
 			f.comment = row[3].(string)
 		}
+		if row[4] != nil {
+			f.owner = row[4].(string)
+		}
 		functions = append(functions, f)
 		dbObjs = append(dbObjs, f)
 	}
 	return functions, dbObjs, nil
 }
 
-func createFunction(dst string, f *function) error {
+func (b *backupRun) createFunction(dst string, f *function) error {
 	log.Infof("Backing up function %s.%s", f.schema, f.name)
+	schema, name := f.dst(b)
 	fText := regexp.MustCompile(`(?s)/\s*$`).ReplaceAllString(f.text, "")
+	if schema != f.schema || name != f.name {
+		fText = regexp.MustCompile(`^(?is)(\s*FUNCTION\s+)("?[\w_-]+"?\.)?"?[\w_-]+"?`).
+			ReplaceAllString(fText, "${1}"+strings.ReplaceAll(b.qd(schema)+"."+b.qd(name), "$", "$$"))
+	}
 	sql := fmt.Sprintf(
-		"OPEN SCHEMA [%s];\n--/\nCREATE OR REPLACE %s\n/\n",
-		f.schema, fText,
+		"OPEN SCHEMA %s;\n--/\nCREATE OR REPLACE %s\n/\n",
+		b.qb(schema), fText,
 	)
 	if f.comment != "" {
 		sql += fmt.Sprintf(
-			"COMMENT ON FUNCTION [%s].[%s] IS '%s';\n",
-			f.schema, f.name, qStr(f.comment),
+			"COMMENT ON FUNCTION %s.%s IS '%s';\n",
+			b.qb(schema), b.qb(name), qStr(f.comment),
 		)
 	}
-	file := filepath.Join(dst, f.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	sql, err := b.transformDDL(FUNCTIONS, f.schema, f.name, sql)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dst, b.fileName(name)+".sql")
+	err = b.writeFile(file, []byte(b.fileHeader(f.schema+"."+f.name)+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup function: %s", err)
 	}
+	b.fileWritten(file)
+	b.bundles.add(schema, "functions", sql)
 	return nil
 }
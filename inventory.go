@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eddyueue/go-exasol-client"
+)
+
+// This backs up a lightweight inventory of schema objects.
+// It lists names/types/counts without generating any per-object DDL or data.
+
+type inventory struct {
+	Schemas []*inventorySchema `json:"schemas"`
+}
+
+type inventorySchema struct {
+	Name    string             `json:"name"`
+	Counts  map[string]int     `json:"counts"`
+	Objects []*inventoryObject `json:"objects"`
+}
+
+type inventoryObject struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Rows *int64 `json:"rows,omitempty"`
+}
+
+func BackupInventory(src *exasol.Conn, dst string, crit Criteria) error {
+	return newBackupRun().backupInventory(src, dst, crit)
+}
+
+func (b *backupRun) backupInventory(src *exasol.Conn, dst string, crit Criteria) error {
+	log.Info("Backing up inventory")
+
+	inv, err := getInventory(src, crit)
+	if err != nil {
+		return err
+	}
+	if len(inv.Schemas) == 0 {
+		log.Warning("Object criteria did not match any schemas")
+	}
+
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode inventory: %s", err)
+	}
+	os.MkdirAll(dst, os.ModePerm)
+	file := filepath.Join(dst, "inventory.json")
+	err = b.writeFile(file, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to backup inventory: %s", err)
+	}
+	b.fileWritten(file)
+
+	log.Info("Done backing up inventory")
+	return nil
+}
+
+func getInventory(conn *exasol.Conn, crit Criteria) (*inventory, error) {
+	sql := fmt.Sprintf(`
+		SELECT root_name   AS s,
+			   object_name AS o,
+			   object_type,
+			   table_row_count
+		FROM exa_all_objects
+		LEFT JOIN exa_all_tables
+		  ON table_schema = root_name
+		 AND table_name = object_name
+		 AND object_type = 'TABLE'
+		WHERE root_type = 'SCHEMA'
+		  AND (%s)
+		ORDER BY local.s, object_type, local.o
+		`, crit.getSQLCriteria(),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get inventory: %s", err)
+	}
+
+	inv := &inventory{Schemas: []*inventorySchema{}}
+	var schema *inventorySchema
+	for _, row := range res {
+		schemaName := row[0].(string)
+		if schema == nil || schema.Name != schemaName {
+			schema = &inventorySchema{
+				Name:    schemaName,
+				Counts:  map[string]int{},
+				Objects: []*inventoryObject{},
+			}
+			inv.Schemas = append(inv.Schemas, schema)
+		}
+		obj := &inventoryObject{
+			Name: row[1].(string),
+			Type: row[2].(string),
+		}
+		if row[3] != nil {
+			rows := int64(row[3].(float64))
+			obj.Rows = &rows
+		}
+		schema.Counts[obj.Type]++
+		schema.Objects = append(schema.Objects, obj)
+	}
+	return inv, nil
+}
@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// This writes a manifest.json describing how the backed up files are
+// stored (e.g. encrypted) so that tooling knows how to read them back,
+// along with anything about the table/view data a restore can't tell
+// from the data files themselves, e.g. that a table's data is a sample
+// or why a table has no data file. It's only written when there's
+// something to record and is itself never encrypted.
+
+const manifestFile = "manifest.json"
+
+type backupManifest struct {
+	// By the path of the (unsplit and unencrypted) data file
+	Data       map[string]*dataManifest `json:"data,omitempty"`
+	Encoding   string                   `json:"encoding,omitempty"` // Of the data files
+	Encryption *encryptionManifest      `json:"encryption,omitempty"`
+	mu         sync.Mutex
+}
+
+type dataManifest struct {
+	Empty    bool            `json:"empty,omitempty"`   // The table has no rows so has no data file
+	Skipped  string          `json:"skipped,omitempty"` // Why the table's data wasn't backed up
+	Sample   *sampleManifest `json:"sample,omitempty"`  // Set if the data is only a sample
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+// The reasons a table's data wasn't backed up
+const (
+	skippedRowLimit = "row limit" // It has more rows than MaxTableRows/TableRowLimits
+	skippedTimeout  = "timeout"   // Its export took longer than ObjectTimeout
+)
+
+var dataSampleNames = map[DataSample]string{
+	FIRST_ROWS:      "FIRST_ROWS",
+	RANDOM_ROWS:     "RANDOM_ROWS",
+	SYSTEMATIC_ROWS: "SYSTEMATIC_ROWS",
+}
+
+type sampleManifest struct {
+	Strategy  string `json:"strategy"`        // The DataSampleStrategy
+	Rows      int    `json:"rows"`            // The most rows sampled
+	TableRows int64  `json:"tableRows"`       // The table's (approximate) row count
+	Every     int    `json:"every,omitempty"` // The interval of SYSTEMATIC_ROWS
+}
+
+type encryptionManifest struct {
+	Algorithm string   `json:"algorithm"`
+	Files     []string `json:"files"`
+}
+
+func newBackupManifest() *backupManifest {
+	return &backupManifest{Data: map[string]*dataManifest{}}
+}
+
+// Records what there is to know about the given data file's
+// (relative to the Destination) data, if anything
+func (m *backupManifest) noteData(dataFile string, d *dataManifest) {
+	if m == nil || d.isEmpty() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Data[filepath.ToSlash(dataFile)] = d
+}
+
+func (d *dataManifest) isEmpty() bool {
+	return !d.Empty && d.Skipped == "" && d.Sample == nil && len(d.Warnings) == 0
+}
+
+func (m *backupManifest) isEmpty() bool {
+	return len(m.Data) == 0 && m.Encoding == "" && m.Encryption == nil
+}
+
+func BackupManifest(dst string) error {
+	return newBackupRun().writeBackupManifest(dst)
+}
+
+func (b *backupRun) writeBackupManifest(dst string) error {
+	log.Info("Backing up manifest")
+
+	m := b.manifest
+	if m == nil {
+		m = newBackupManifest()
+	}
+	if b.option.outputEncoding != nil {
+		m.Encoding = b.option.outputEncoding.name
+	}
+	if b.option.encrypt != nil {
+		m.Encryption = &encryptionManifest{Algorithm: encryptedAlgorithm, Files: []string{}}
+		err := filepath.Walk(dst, func(fp string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(fp, encryptedExt) {
+				return nil
+			}
+			relPath, err := filepath.Rel(dst, fp)
+			if err != nil {
+				return err
+			}
+			m.Encryption.Files = append(m.Encryption.Files, filepath.ToSlash(relPath))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to list encrypted files: %s", err)
+		}
+	}
+	err := b.writeManifest(dst, m)
+	if err != nil {
+		return err
+	}
+	if !m.isEmpty() {
+		b.fileStored(filepath.Join(dst, manifestFile))
+	}
+
+	log.Info("Done backing up manifest")
+	return nil
+}
+
+func readManifest(dir string) (*backupManifest, error) {
+	m := &backupManifest{}
+	fp := filepath.Join(dir, manifestFile)
+	data, err := ioutil.ReadFile(fp)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read file %s: %s", fp, err)
+	}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse file %s: %s", fp, err)
+	}
+	return m, nil
+}
+
+// Writes the manifest (unencrypted) or removes it if there's nothing to record
+func (b *backupRun) writeManifest(dir string, m *backupManifest) error {
+	fp := filepath.Join(dir, manifestFile)
+	if m.isEmpty() {
+		os.Remove(fp)
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode manifest: %s", err)
+	}
+	err = b.writeRawFile(fp, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to backup manifest: %s", err)
+	}
+	return nil
+}
+
+// Once a backup's been decrypted its files are no longer encrypted
+func (b *backupRun) removeManifestEncryption(dir string) error {
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	m.Encryption = nil
+	return b.writeManifest(dir, m)
+}
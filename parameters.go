@@ -2,9 +2,9 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/eddyueue/go-exasol-client"
 )
@@ -16,17 +16,86 @@ type parameter struct {
 	value string
 }
 
+// The defaults of the system parameters as documented for ALTER SYSTEM
+// by each Exasol major version. They're used when only non-default
+// parameters are backed up. Parameters which are set up at installation
+// (like TIME_ZONE and SCRIPT_LANGUAGES) aren't listed and neither are
+// those without a documented default for the version, so they're always
+// backed up. For versions not listed here every parameter is backed up.
+var parameterDefaults = map[int]map[string]string{
+	7: {
+		"CONSTRAINT_STATE_DEFAULT":      "ENABLE",
+		"DEFAULT_CONSUMER_GROUP":        "MEDIUM",
+		"DEFAULT_LIKE_ESCAPE_CHARACTER": `\`,
+		"HASHTYPE_FORMAT":               "HEX",
+		"NLS_DATE_FORMAT":               "YYYY-MM-DD",
+		"NLS_DATE_LANGUAGE":             "ENG",
+		"NLS_FIRST_DAY_OF_WEEK":         "7",
+		"NLS_NUMERIC_CHARACTERS":        ".,",
+		"NLS_TIMESTAMP_FORMAT":          "YYYY-MM-DD HH24:MI:SS.FF3",
+		"PASSWORD_EXPIRY_POLICY":        "OFF",
+		"PASSWORD_SECURITY_POLICY":      "OFF",
+		"PROFILE":                       "OFF",
+		"QUERY_CACHE":                   "ON",
+		"QUERY_TIMEOUT":                 "0",
+		"SCRIPT_OUTPUT_ADDRESS":         "",
+		"SNAPSHOT_MODE":                 "OFF",
+		"SQL_PREPROCESSOR_SCRIPT":       "",
+		"ST_MAX_DECIMAL_DIGITS":         "16",
+		"TEMP_DB_RAM_LIMIT":             "OFF",
+		"TIMESTAMP_ARITHMETIC_BEHAVIOR": "INTERVAL",
+		"TIME_ZONE_BEHAVIOR":            "INVALID SHIFT AMBIGUOUS ST",
+	},
+	8: {
+		"CONSTRAINT_STATE_DEFAULT":      "ENABLE",
+		"DEFAULT_CONSUMER_GROUP":        "MEDIUM",
+		"DEFAULT_LIKE_ESCAPE_CHARACTER": `\`,
+		"HASHTYPE_FORMAT":               "HEX",
+		"IDLE_TIMEOUT":                  "86400",
+		"NLS_DATE_FORMAT":               "YYYY-MM-DD",
+		"NLS_DATE_LANGUAGE":             "ENG",
+		"NLS_FIRST_DAY_OF_WEEK":         "7",
+		"NLS_NUMERIC_CHARACTERS":        ".,",
+		"NLS_TIMESTAMP_FORMAT":          "YYYY-MM-DD HH24:MI:SS.FF6",
+		"PASSWORD_EXPIRY_POLICY":        "OFF",
+		"PASSWORD_SECURITY_POLICY":      "OFF",
+		"PROFILE":                       "OFF",
+		"QUERY_CACHE":                   "ON",
+		"QUERY_TIMEOUT":                 "0",
+		"REPLICATION_BORDER":            "100000",
+		"SCRIPT_OUTPUT_ADDRESS":         "",
+		"SESSION_TEMP_DB_RAM_LIMIT":     "OFF",
+		"SNAPSHOT_MODE":                 "SYSTEM TABLES",
+		"SQL_PREPROCESSOR_SCRIPT":       "",
+		"ST_MAX_DECIMAL_DIGITS":         "16",
+		"TEMP_DB_RAM_LIMIT":             "OFF",
+		"TIMESTAMP_ARITHMETIC_BEHAVIOR": "INTERVAL",
+		"TIME_ZONE_BEHAVIOR":            "INVALID SHIFT AMBIGUOUS ST",
+		"USER_TEMP_DB_RAM_LIMIT":        "OFF",
+	},
+}
+
 func BackupParameters(src *exasol.Conn, dst string) error {
+	return newBackupRun().backupParameters(src, dst)
+}
+
+func (b *backupRun) backupParameters(src *exasol.Conn, dst string) error {
 	log.Info("Backing up parameters")
 
-	parameters, err := getParametersToBackup(src)
+	parameters, err := b.getParametersToBackup(src)
 	if err != nil {
 		return err
 	}
 	if len(parameters) == 0 {
+		if !b.option.allParameters {
+			log.Info("All parameters have their default values")
+			os.Remove(filepath.Join(dst, "parameters.sql"))
+			return nil
+		}
 		log.Warning("No parameters found")
 		return nil
 	}
+	b.countObjects(PARAMETERS, len(parameters))
 
 	var sql string
 	for _, parameter := range parameters {
@@ -35,16 +104,17 @@ func BackupParameters(src *exasol.Conn, dst string) error {
 
 	os.MkdirAll(dst, os.ModePerm)
 	file := filepath.Join(dst, "parameters.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = b.writeFile(file, []byte(b.fileHeader("parameters")+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup parameters: %s", err)
 	}
+	b.fileWritten(file)
 
 	log.Info("Done backing up parameters")
 	return nil
 }
 
-func getParametersToBackup(conn *exasol.Conn) ([]*parameter, error) {
+func (b *backupRun) getParametersToBackup(conn *exasol.Conn) ([]*parameter, error) {
 	sql := `
 		SELECT parameter_name,
 			   system_value
@@ -56,6 +126,14 @@ func getParametersToBackup(conn *exasol.Conn) ([]*parameter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get parameters to backup: %s", err)
 	}
+	var defaults map[string]string
+	if !b.option.allParameters {
+		var ok bool
+		defaults, ok = parameterDefaults[int(capability.version)]
+		if !ok {
+			log.Infof("No documented parameter defaults for Exasol %v so all are backed up", capability.version)
+		}
+	}
 	parameters := []*parameter{}
 	for _, row := range res {
 		p := &parameter{name: row[0].(string)}
@@ -63,21 +141,32 @@ func getParametersToBackup(conn *exasol.Conn) ([]*parameter, error) {
 		if row[1] != nil {
 			p.value = row[1].(string)
 		}
+		if def, ok := defaults[p.name]; ok && p.value == def {
+			continue
+		}
 		parameters = append(parameters, p)
 	}
+	// Backstop the ORDER BY so the output is reproducible
+	sort.Slice(parameters, func(i, j int) bool {
+		return parameters[i].name < parameters[j].name
+	})
 	return parameters, nil
 }
 
 func createParameter(p *parameter) string {
 	log.Infof("Backing up parameter %s", p.name)
-	q := "'"
-	if p.name == "NLS_FIRST_DAY_OF_WEEK" ||
-		p.name == "QUERY_TIMEOUT" ||
-		p.name == "SQL_PREPROCESSOR_SCRIPT" ||
-		p.name == "DEFAULT_PRIORITY_GROUP" ||
-		p.name == "DEFAULT_CONSUMER_GROUP" {
+	return fmt.Sprintf("ALTER SYSTEM SET %s=%s;\n", p.name, parameterValue(p.name, p.value))
+}
+
+// Returns the value as it's given in an ALTER SYSTEM/SESSION
+func parameterValue(name, value string) string {
+	if name == "NLS_FIRST_DAY_OF_WEEK" ||
+		name == "QUERY_TIMEOUT" ||
+		name == "SQL_PREPROCESSOR_SCRIPT" ||
+		name == "DEFAULT_PRIORITY_GROUP" ||
+		name == "DEFAULT_CONSUMER_GROUP" {
 		// These params don't need quotes
-		q = ""
+		return value
 	}
-	return fmt.Sprintf("ALTER SYSTEM SET %s=%s%s%s;\n", p.name, q, p.value, q)
+	return "'" + value + "'"
 }
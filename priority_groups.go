@@ -2,9 +2,9 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/eddyueue/go-exasol-client"
 )
@@ -18,6 +18,10 @@ type priorityGroup struct {
 }
 
 func BackupPriorityGroups(src *exasol.Conn, dst string) error {
+	return newBackupRun().backupPriorityGroups(src, dst)
+}
+
+func (b *backupRun) backupPriorityGroups(src *exasol.Conn, dst string) error {
 	log.Info("Backing up priority groups")
 
 	priorityGroups, err := getPriorityGroupsToBackup(src)
@@ -28,18 +32,20 @@ func BackupPriorityGroups(src *exasol.Conn, dst string) error {
 		log.Warning("No priority groups found")
 		return nil
 	}
+	b.countObjects(PRIORITY_GROUPS, len(priorityGroups))
 
 	var sql string
 	for _, priorityGroup := range priorityGroups {
-		sql += createPriorityGroup(priorityGroup)
+		sql += b.createPriorityGroup(priorityGroup)
 	}
 
 	os.MkdirAll(dst, os.ModePerm)
 	file := filepath.Join(dst, "priority_groups.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = b.writeFile(file, []byte(b.fileHeader("priority groups")+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup priority groups: %s", err)
 	}
+	b.fileWritten(file)
 
 	log.Info("Done backing up priority groups")
 	return nil
@@ -68,25 +74,29 @@ func getPriorityGroupsToBackup(conn *exasol.Conn) ([]*priorityGroup, error) {
 		}
 		priorityGroups = append(priorityGroups, p)
 	}
+	// Backstop the ORDER BY so the output is reproducible
+	sort.Slice(priorityGroups, func(i, j int) bool {
+		return priorityGroups[i].name < priorityGroups[j].name
+	})
 	return priorityGroups, nil
 }
 
-func createPriorityGroup(p *priorityGroup) string {
+func (b *backupRun) createPriorityGroup(p *priorityGroup) string {
 	log.Infof("Backing up priority group %s", p.name)
 	sql := ""
 	if p.name == "MEDIUM" {
-		sql = fmt.Sprintf("ALTER PRIORITY GROUP [%s] SET WEIGHT = %d;\n", p.name, p.weight)
+		sql = fmt.Sprintf("ALTER PRIORITY GROUP %s SET WEIGHT = %d;\n", b.qb(p.name), p.weight)
 	} else {
 		sql = fmt.Sprintf(
-			"DROP PRIORITY GROUP [%s];\n"+
-				"CREATE PRIORITY GROUP [%s] WITH WEIGHT = %d;\n",
-			p.name, p.name, p.weight,
+			"DROP PRIORITY GROUP %s;\n"+
+				"CREATE PRIORITY GROUP %s WITH WEIGHT = %d;\n",
+			b.qb(p.name), b.qb(p.name), p.weight,
 		)
 	}
 	if p.comment != "" {
 		sql += fmt.Sprintf(
-			"COMMENT ON PRIORITY GROUP [%s] IS '%s';\n",
-			p.name, qStr(p.comment),
+			"COMMENT ON PRIORITY GROUP %s IS '%s';\n",
+			b.qb(p.name), qStr(p.comment),
 		)
 	}
 	return sql
@@ -2,30 +2,41 @@ package backup
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/eddyueue/go-exasol-client"
 )
 
+// Appends the grantees' privileges to their already backed up files
+//
+// Deprecated: BackupUsers and BackupRoles write each grantee's privileges
+// (along with its priority/consumer group) with its definition. This only
+// appends the grants, without the group statements.
 func BackupPrivileges(src *exasol.Conn, dst string, grantees []string) error {
-	for i := range grantees {
-		grantees[i] = "'" + grantees[i] + "'"
-	}
-	privs := []func(*exasol.Conn, string, []string) error{
-		backupConnectionPrivs,
-		backupRestrictedObjectPrivs,
-		backupObjectPrivs,
-		backupRolePrivs,
-		backupSystemPrivs,
-		backupImpersonationPrivs,
-		backupSchemaOwners,
+	return newBackupRun().backupPrivileges(src, dst, grantees)
+}
+
+func (b *backupRun) backupPrivileges(src *exasol.Conn, dst string, grantees []string) error {
+	privs, err := b.getPrivileges(src, grantees, nil)
+	if err != nil {
+		return err
 	}
-	for _, backupPriv := range privs {
-		err := backupPriv(src, dst, grantees)
+	for _, grantee := range grantees {
+		if privs[grantee] == "" {
+			continue
+		}
+		fp := filepath.Join(dst, b.fileName(grantee)+".sql")
+		data, err := b.readBackupFile(fp)
 		if err != nil {
-			return err
+			return fmt.Errorf("Unable to open file '%s': %s", fp, err)
+		}
+		// Rewritten as a whole rather than appended to since an encrypted
+		// file can't be appended to and so that with AtomicWrites the
+		// file is never seen partially written.
+		err = b.writeFile(fp, append(data, privs[grantee]...))
+		if err != nil {
+			return fmt.Errorf("Unable to write to file '%s': %s", fp, err)
 		}
 	}
 
@@ -33,7 +44,59 @@ func BackupPrivileges(src *exasol.Conn, dst string, grantees []string) error {
 	return nil
 }
 
-func backupConnectionPrivs(src *exasol.Conn, dst string, grantees []string) error {
+// Returns the SQL of each grantee's privileges. Each category of grants
+// is kept together (and sorted within) so that the grantee files are
+// easy to audit and diff. The categories are in this order: roles,
+// system, object, connection, restricted connection access and
+// impersonation privileges, then the groups (the grantees'
+// priority/consumer group statements) and lastly schema ownership.
+func (b *backupRun) getPrivileges(src *exasol.Conn, grantees []string, groups map[string]string) (map[string]string, error) {
+	var quoted []string
+	for _, grantee := range grantees {
+		quoted = append(quoted, "'"+qStr(grantee)+"'")
+	}
+	privs := map[string]string{}
+	if len(quoted) == 0 {
+		return privs, nil
+	}
+	getGroups := func(*exasol.Conn, []string, map[string]string) error {
+		for grantee, sql := range groups {
+			privs[grantee] += sql
+		}
+		return nil
+	}
+	categories := []func(*exasol.Conn, []string, map[string]string) error{
+		b.getRolePrivs,
+		b.getSystemPrivs,
+		b.getObjectPrivs,
+		b.getConnectionPrivs,
+		b.getRestrictedObjectPrivs,
+		b.getImpersonationPrivs,
+		getGroups,
+		b.getSchemaOwners,
+	}
+	for _, getPrivs := range categories {
+		err := getPrivs(src, quoted, privs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return privs, nil
+}
+
+// Returns the statement putting a user/role into its priority/consumer group
+func (b *backupRun) getGroupSQL(objType, name, group string) string {
+	group = b.remapGroup(group)
+	if group == "" {
+		return ""
+	}
+	if capability.consumerGroups {
+		return fmt.Sprintf("ALTER %s %s SET CONSUMER_GROUP = %s;\n", objType, b.qb(name), b.qb(group))
+	}
+	return fmt.Sprintf("GRANT PRIORITY GROUP %s TO %s;\n", b.qb(group), b.qb(name))
+}
+
+func (b *backupRun) getConnectionPrivs(src *exasol.Conn, grantees []string, privs map[string]string) error {
 	log.Info("Backing up connection privileges")
 
 	sql := fmt.Sprintf(`
@@ -51,20 +114,17 @@ func backupConnectionPrivs(src *exasol.Conn, dst string, grantees []string) erro
 		grantee := row[0].(string)
 		connection := row[1].(string)
 		adminOption := row[2].(bool)
-		sql := fmt.Sprintf("GRANT CONNECTION %s TO [%s]", connection, grantee)
+		sql := fmt.Sprintf("GRANT CONNECTION %s TO %s", connection, b.qb(grantee))
 		if adminOption {
 			sql += " WITH ADMIN OPTION"
 		}
 		sql += ";\n"
-		err = appendToObjFile(dst, grantee, sql)
-		if err != nil {
-			return err
-		}
+		privs[grantee] += sql
 	}
 	return nil
 }
 
-func backupObjectPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func (b *backupRun) getObjectPrivs(src *exasol.Conn, grantees []string, privs map[string]string) error {
 	log.Info("Backing up object privileges")
 
 	sql := fmt.Sprintf(`
@@ -86,21 +146,18 @@ func backupObjectPrivs(src *exasol.Conn, dst string, grantees []string) error {
 
 		var object string
 		if objType == "SCHEMA" {
-			object = row[1].(string)
+			object = b.qb(row[1].(string))
 		} else {
-			object = row[0].(string) + "].[" + row[1].(string)
+			object = b.qb(row[0].(string)) + "." + b.qb(row[1].(string))
 		}
 
-		sql := fmt.Sprintf("GRANT %s ON %s [%s] TO [%s];\n", privilege, objType, object, grantee)
-		err = appendToObjFile(dst, grantee, sql)
-		if err != nil {
-			return err
-		}
+		sql := fmt.Sprintf("GRANT %s ON %s %s TO %s;\n", privilege, objType, object, b.qb(grantee))
+		privs[grantee] += sql
 	}
 	return nil
 }
 
-func backupRestrictedObjectPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func (b *backupRun) getRestrictedObjectPrivs(src *exasol.Conn, grantees []string, privs map[string]string) error {
 	log.Info("Backing up restricted object privileges")
 
 	sql := fmt.Sprintf(`
@@ -124,30 +181,27 @@ func backupRestrictedObjectPrivs(src *exasol.Conn, dst string, grantees []string
 
 		var object string
 		if row[0] == nil {
-			object = row[1].(string)
+			object = b.qb(row[1].(string))
 		} else {
-			object = row[0].(string) + "].[" + row[1].(string)
+			object = b.qb(row[0].(string)) + "." + b.qb(row[1].(string))
 		}
 		var forObject string
 		if row[3] == nil {
-			forObject = row[4].(string)
+			forObject = b.qb(row[4].(string))
 		} else {
-			forObject = row[3].(string) + "].[" + row[4].(string)
+			forObject = b.qb(row[3].(string)) + "." + b.qb(row[4].(string))
 		}
 
 		sql := fmt.Sprintf(
-			`GRANT %s ON %s [%s] FOR %s [%s] TO [%s];`+"\n",
-			privilege, objType, object, forObjType, forObject, grantee,
+			`GRANT %s ON %s %s FOR %s %s TO %s;`+"\n",
+			privilege, objType, object, forObjType, forObject, b.qb(grantee),
 		)
-		err = appendToObjFile(dst, grantee, sql)
-		if err != nil {
-			return err
-		}
+		privs[grantee] += sql
 	}
 	return nil
 }
 
-func backupRolePrivs(src *exasol.Conn, dst string, grantees []string) error {
+func (b *backupRun) getRolePrivs(src *exasol.Conn, grantees []string, privs map[string]string) error {
 	log.Info("Backing up role privileges")
 
 	sql := fmt.Sprintf(`
@@ -166,20 +220,17 @@ func backupRolePrivs(src *exasol.Conn, dst string, grantees []string) error {
 		role := row[1].(string)
 		adminOption := row[2].(bool)
 
-		sql := fmt.Sprintf("GRANT [%s] TO [%s]", role, grantee)
+		sql := fmt.Sprintf("GRANT %s TO %s", b.qb(role), b.qb(grantee))
 		if adminOption {
 			sql += " WITH ADMIN OPTION"
 		}
 		sql += ";\n"
-		err = appendToObjFile(dst, grantee, sql)
-		if err != nil {
-			return err
-		}
+		privs[grantee] += sql
 	}
 	return nil
 }
 
-func backupSystemPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func (b *backupRun) getSystemPrivs(src *exasol.Conn, grantees []string, privs map[string]string) error {
 	log.Info("Backing up system privileges")
 
 	sql := fmt.Sprintf(`
@@ -198,20 +249,17 @@ func backupSystemPrivs(src *exasol.Conn, dst string, grantees []string) error {
 		privilege := row[1].(string)
 		adminOption := row[2].(bool)
 
-		sql := fmt.Sprintf("GRANT %s TO [%s]", privilege, grantee)
+		sql := fmt.Sprintf("GRANT %s TO %s", privilege, b.qb(grantee))
 		if adminOption {
 			sql += " WITH ADMIN OPTION"
 		}
 		sql += ";\n"
-		err = appendToObjFile(dst, grantee, sql)
-		if err != nil {
-			return err
-		}
+		privs[grantee] += sql
 	}
 	return nil
 }
 
-func backupImpersonationPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func (b *backupRun) getImpersonationPrivs(src *exasol.Conn, grantees []string, privs map[string]string) error {
 	log.Info("Backing up impersonation privileges")
 
 	sql := fmt.Sprintf(`
@@ -229,16 +277,13 @@ func backupImpersonationPrivs(src *exasol.Conn, dst string, grantees []string) e
 		grantee := row[0].(string)
 		impersonationOn := row[1].(string)
 
-		sql := fmt.Sprintf("GRANT IMPERSONATION ON [%s] TO [%s];\n", impersonationOn, grantee)
-		err = appendToObjFile(dst, grantee, sql)
-		if err != nil {
-			return err
-		}
+		sql := fmt.Sprintf("GRANT IMPERSONATION ON %s TO %s;\n", b.qb(impersonationOn), b.qb(grantee))
+		privs[grantee] += sql
 	}
 	return nil
 }
 
-func backupSchemaOwners(src *exasol.Conn, dst string, grantees []string) error {
+func (b *backupRun) getSchemaOwners(src *exasol.Conn, grantees []string, privs map[string]string) error {
 	log.Info("Backing up schema owners")
 
 	sql := fmt.Sprintf(`
@@ -264,25 +309,8 @@ func backupSchemaOwners(src *exasol.Conn, dst string, grantees []string) error {
 			virtual = "VIRTUAL "
 		}
 
-		sql := fmt.Sprintf("ALTER %sSCHEMA [%s] CHANGE OWNER [%s];\n", virtual, schema, owner)
-		err = appendToObjFile(dst, owner, sql)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func appendToObjFile(dst, user, sql string) error {
-	fp := filepath.Join(dst, user+".sql")
-	f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("Unable to open file '%s': %s", fp, err)
-	}
-	_, err = f.Write([]byte(sql))
-	if err != nil {
-		return fmt.Errorf("Unable to write to file '%s': %s", fp, err)
+		sql := fmt.Sprintf("ALTER %sSCHEMA %s CHANGE OWNER %s;\n", virtual, b.qb(schema), b.qb(owner))
+		privs[owner] += sql
 	}
-	f.Close()
 	return nil
 }
@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// This tracks the data files completed by a Resume run so that
+// a run which fails part way through can later be resumed.
+// The progress file doubles as a sentinel marking the run as incomplete
+// and is only removed once the run finishes. Split data is tracked as
+// a whole by a checksum over all of its chunks.
+
+const progressFile = ".backup_incomplete"
+
+type backupProgress struct {
+	dst  string
+	done map[string]string // relative path -> sha256
+	mu   sync.Mutex
+	run  *backupRun
+}
+
+// Returns nil (i.e. nothing is tracked) unless resume is set
+func (b *backupRun) startProgress(dst string, resume bool) (*backupProgress, error) {
+	fp := filepath.Join(dst, progressFile)
+	if !resume {
+		// A prior incomplete run can't be resumed after this one
+		os.Remove(fp)
+		return nil, nil
+	}
+	p := &backupProgress{dst: dst, done: map[string]string{}, run: b}
+
+	f, err := os.Open(fp)
+	if err == nil {
+		log.Info("Resuming incomplete backup")
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), " ", 2)
+			if len(parts) == 2 {
+				p.done[parts[1]] = parts[0]
+			}
+		}
+		f.Close()
+		return p, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to read file %s: %s", fp, err)
+	}
+
+	f, err = os.Create(fp)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create file %s: %s", fp, err)
+	}
+	f.Close()
+	return p, nil
+}
+
+// Returns true if the file was completed by a prior run
+// and hasn't been changed since.
+func (p *backupProgress) isDone(relPath string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	sum, ok := p.done[relPath]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	gotSum, err := p.run.dataChecksum(filepath.Join(p.dst, relPath))
+	return err == nil && gotSum == sum
+}
+
+func (p *backupProgress) markDone(relPath string) error {
+	if p == nil {
+		return nil
+	}
+	sum, err := p.run.dataChecksum(filepath.Join(p.dst, relPath))
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[relPath] = sum
+	fp := filepath.Join(p.dst, progressFile)
+	f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open file '%s': %s", fp, err)
+	}
+	_, err = f.Write([]byte(sum + " " + relPath + "\n"))
+	if err != nil {
+		return fmt.Errorf("Unable to write to file '%s': %s", fp, err)
+	}
+	f.Close()
+	return nil
+}
+
+func (p *backupProgress) finish() {
+	if p == nil {
+		return
+	}
+	os.Remove(filepath.Join(p.dst, progressFile))
+}
+
+// Returns the checksum of a data file. If the data is split then it's
+// the checksum of all its chunks prefixed with MaxRowsPerFile so that
+// data split differently isn't mistaken for being done.
+func (b *backupRun) dataChecksum(csvFile string) (string, error) {
+	if b.option.maxRowsPerFile == 0 {
+		return fileChecksum(b.storedPath(csvFile))
+	}
+	chunks := b.dataChunks(csvFile)
+	if len(chunks) == 0 {
+		return "", fmt.Errorf("Unable to find the data files of %s", csvFile)
+	}
+	h := sha256.New()
+	for _, chunk := range chunks {
+		sum, err := fileChecksum(chunk)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", sum, filepath.Base(chunk))
+	}
+	return fmt.Sprintf("%d:%s", b.option.maxRowsPerFile, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+func fileChecksum(fp string) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open file %s: %s", fp, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read file %s: %s", fp, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
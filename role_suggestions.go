@@ -0,0 +1,154 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/eddyueue/go-exasol-client"
+)
+
+// This backs up an advisory role_suggestions.json proposing roles which
+// would consolidate the privileges that several users have each been
+// granted directly. It's purely an analysis aid. The per-user grants
+// backed up with the users remain the authoritative ones and nothing
+// here is meant to be restored.
+
+type roleSuggestion struct {
+	Role   string   `json:"role"`
+	Users  []string `json:"users"`
+	Grants []string `json:"grants"`
+}
+
+func BackupRoleSuggestions(src *exasol.Conn, dst string) error {
+	return newBackupRun().backupRoleSuggestions(src, dst)
+}
+
+func (b *backupRun) backupRoleSuggestions(src *exasol.Conn, dst string) error {
+	log.Info("Backing up role suggestions")
+
+	userGrants, err := b.getUserGrants(src)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(getRoleSuggestions(userGrants))
+	if err != nil {
+		return fmt.Errorf("Unable to encode role suggestions: %s", err)
+	}
+	os.MkdirAll(dst, os.ModePerm)
+	file := filepath.Join(dst, "role_suggestions.json")
+	err = b.writeFile(file, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Unable to backup role suggestions: %s", err)
+	}
+	b.fileWritten(file)
+
+	log.Info("Done backing up role suggestions")
+	return nil
+}
+
+// Returns a map of each directly granted privilege
+// (without the grantee) to the users it's granted to.
+func (b *backupRun) getUserGrants(conn *exasol.Conn) (map[string][]string, error) {
+	res, err := conn.FetchSlice(`
+		SELECT DISTINCT *
+		FROM (
+			SELECT grantee,
+				   'ROLE' AS grant_type,
+				   granted_role AS privilege,
+				   CAST(NULL AS VARCHAR(2000000)) AS obj,
+				   admin_option
+			FROM exa_dba_role_privs
+			UNION ALL
+			SELECT grantee, 'SYSTEM', privilege, NULL, admin_option
+			FROM exa_dba_sys_privs
+			UNION ALL
+			SELECT grantee, 'CONNECTION', granted_connection, NULL, admin_option
+			FROM exa_dba_connection_privs
+			UNION ALL
+			SELECT grantee, object_type, privilege,
+				   CASE WHEN object_type = 'SCHEMA' THEN object_name
+				   ELSE object_schema || '.' || object_name END,
+				   FALSE
+			FROM exa_dba_obj_privs
+		)
+		WHERE grantee IN (
+			SELECT user_name FROM exa_dba_users WHERE user_name != 'SYS'
+		)
+		ORDER BY 1, 2, 3, 4
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get user grants: %s", err)
+	}
+	grants := map[string][]string{}
+	for _, row := range res {
+		grantee := row[0].(string)
+		grantType := row[1].(string)
+		privilege := row[2].(string)
+
+		var grant string
+		switch grantType {
+		case "ROLE":
+			grant = b.qb(privilege)
+		case "SYSTEM":
+			grant = privilege
+		case "CONNECTION":
+			grant = "CONNECTION " + privilege
+		default:
+			var objParts []string
+			for _, p := range strings.SplitN(row[3].(string), ".", 2) {
+				objParts = append(objParts, b.qb(p))
+			}
+			grant = fmt.Sprintf("%s ON %s %s", privilege, grantType, strings.Join(objParts, "."))
+		}
+		if row[4].(bool) {
+			grant += " WITH ADMIN OPTION"
+		}
+		grants[grant] = append(grants[grant], grantee)
+	}
+	return grants, nil
+}
+
+// Groups the grants shared by the same (2 or more) users into a
+// suggested role per set of users.
+func getRoleSuggestions(userGrants map[string][]string) []*roleSuggestion {
+	byUsers := map[string]*roleSuggestion{}
+	for grant, users := range userGrants {
+		if len(users) < 2 {
+			continue
+		}
+		sort.Strings(users)
+		key := strings.Join(users, "\x00")
+		if byUsers[key] == nil {
+			byUsers[key] = &roleSuggestion{Users: users}
+		}
+		byUsers[key].Grants = append(byUsers[key].Grants, grant)
+	}
+
+	suggestions := []*roleSuggestion{}
+	for _, s := range byUsers {
+		sort.Strings(s.Grants)
+		suggestions = append(suggestions, s)
+	}
+	// The roles shared by the most users first
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if len(a.Users) != len(b.Users) {
+			return len(a.Users) > len(b.Users)
+		}
+		return strings.Join(a.Users, "\x00") < strings.Join(b.Users, "\x00")
+	})
+	for i, s := range suggestions {
+		s.Role = fmt.Sprintf("SHARED_ROLE_%d", i+1)
+	}
+	return suggestions
+}
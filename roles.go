@@ -2,7 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -16,6 +15,10 @@ type role struct {
 }
 
 func BackupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
+	return newBackupRun().backupRoles(src, dst, dropExtras)
+}
+
+func (b *backupRun) backupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
 	log.Info("Backing up roles")
 
 	roles, err := getRolesToBackup(src)
@@ -26,6 +29,7 @@ func BackupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
 		log.Warning("No roles found")
 		return nil
 	}
+	b.countObjects(ROLES, len(roles))
 
 	dir := filepath.Join(dst, "roles")
 	if dropExtras {
@@ -35,20 +39,25 @@ func BackupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
 	os.MkdirAll(dir, os.ModePerm)
 
 	roleNames := []string{}
+	groups := map[string]string{}
 	for _, role := range roles {
-		err = createRole(dir, role)
-		if err != nil {
-			return err
-		}
+		// DBA implicitly has every privilege but PUBLIC's privileges
+		// must be backed up since they're granted to every user.
 		if role.name != "DBA" {
 			roleNames = append(roleNames, role.name)
 		}
+		groups[role.name] = b.getGroupSQL("ROLE", role.name, role.consumerGroup)
 	}
-
-	err = BackupPrivileges(src, dir, roleNames)
+	privs, err := b.getPrivileges(src, roleNames, groups)
 	if err != nil {
 		return err
 	}
+	for _, role := range roles {
+		err = b.createRole(dir, role, privs[role.name])
+		if err != nil {
+			return err
+		}
+	}
 
 	log.Info("Done backing up roles")
 	return nil
@@ -87,28 +96,22 @@ func getRolesToBackup(conn *exasol.Conn) ([]*role, error) {
 	return roles, nil
 }
 
-func createRole(dst string, r *role) error {
+func (b *backupRun) createRole(dst string, r *role, privs string) error {
 	log.Infof("Backing up role %s", r.name)
 
 	var sql string
 	if r.name != "DBA" && r.name != "PUBLIC" {
-		sql = "CREATE ROLE [" + r.name + "];\n"
-	}
-	if r.consumerGroup != "" {
-		if capability.consumerGroups {
-			sql += fmt.Sprintf("ALTER ROLE [%s] SET CONSUMER_GROUP = [%s];\n", r.name, r.consumerGroup)
-		} else {
-			sql += fmt.Sprintf("GRANT PRIORITY GROUP [%s] TO %s;\n", r.consumerGroup, r.name)
-		}
+		sql = "CREATE ROLE " + b.qb(r.name) + ";\n"
 	}
 	if r.comment != "" {
-		sql += fmt.Sprintf("COMMENT ON ROLE [%s] IS '%s';\n", r.name, qStr(r.comment))
+		sql += fmt.Sprintf("COMMENT ON ROLE %s IS '%s';\n", b.qb(r.name), qStr(r.comment))
 	}
 
-	file := filepath.Join(dst, r.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	file := filepath.Join(dst, b.fileName(r.name)+".sql")
+	err := b.writeFile(file, []byte(b.fileHeader(r.name)+sql+privs))
 	if err != nil {
 		return fmt.Errorf("Unable to backup role: %s", err)
 	}
+	b.fileWritten(file)
 	return nil
 }
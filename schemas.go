@@ -2,9 +2,9 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/eddyueue/go-exasol-client"
@@ -18,6 +18,8 @@ type schema struct {
 	isVirtual    bool
 	adapter      string
 	sizeLimit    uint64
+	owner        string
+	rawSize      int64
 	vSchemaProps []*vSchemaProp
 }
 
@@ -30,6 +32,10 @@ func (s *schema) Schema() string { return s.name }
 func (s *schema) Name() string   { return "" }
 
 func BackupSchemas(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
+	return newBackupRun().backupSchemas(src, dst, crit, dropExtras)
+}
+
+func (b *backupRun) backupSchemas(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Infof("Backing up schemas")
 
 	schemas, dbObjs, err := getSchemasToBackup(src, crit)
@@ -37,23 +43,35 @@ func BackupSchemas(src *exasol.Conn, dst string, crit Criteria, dropExtras bool)
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("schemas", dbObjs, dst, crit)
+		b.removeExtraObjects(SCHEMAS, dbObjs, dst, crit)
 	}
 
 	if len(schemas) == 0 {
 		log.Warning("Object criteria did not match any schemas")
 		return nil
 	}
+	sort.SliceStable(schemas, func(i, j int) bool {
+		return b.schemaRank(schemas[i].name) < b.schemaRank(schemas[j].name)
+	})
 
 	err = addVirtualSchemaProps(src, schemas, crit)
 	if err != nil {
 		return err
 	}
+	var selected []*schema
+	for _, s := range schemas {
+		if b.isSelected(s.discovered()) {
+			selected = append(selected, s)
+		}
+	}
+	schemas = selected
+	b.countObjects(SCHEMAS, len(schemas))
+	b.checkSchemaOwners(src, schemas)
 
 	dir := filepath.Join(dst, "schemas")
 	os.MkdirAll(dir, os.ModePerm)
 	for _, schema := range schemas {
-		err = createSchema(dir, schema)
+		err = b.createSchema(dir, schema)
 		if err != nil {
 			return err
 		}
@@ -75,7 +93,9 @@ func getSchemasToBackup(conn *exasol.Conn, crit Criteria) ([]*schema, []dbObj, e
 			   schema_comment,
 			   schema_is_virtual,
 			   %s,
-			   raw_object_size_limit
+			   raw_object_size_limit,
+			   schema_owner,
+			   raw_object_size
 		FROM exa_schemas AS s
 		JOIN exa_all_object_sizes AS os
 		  ON s.schema_name = os.object_name
@@ -106,12 +126,67 @@ func getSchemasToBackup(conn *exasol.Conn, crit Criteria) ([]*schema, []dbObj, e
 		if row[5] != nil {
 			s.sizeLimit = uint64(row[5].(float64))
 		}
+		if row[6] != nil {
+			s.owner = row[6].(string)
+		}
+		if row[7] != nil {
+			s.rawSize = int64(row[7].(float64))
+		}
 		schemas = append(schemas, s)
 		dbObjs = append(dbObjs, s)
 	}
 	return schemas, dbObjs, nil
 }
 
+// A schema's CHANGE OWNER is backed up with its owner's user/role as
+// the owner has to be created first. This warns about schemas whose
+// owner isn't part of the backup.
+func (b *backupRun) checkSchemaOwners(conn *exasol.Conn, schemas []*schema) {
+	var queries []string
+	if b.option.users {
+		queries = append(queries, "SELECT user_name FROM exa_dba_users")
+	}
+	if b.option.roles {
+		queries = append(queries, "SELECT role_name FROM exa_all_roles")
+	}
+	var backedUp []string
+	if len(queries) > 0 {
+		res, err := conn.FetchSlice(strings.Join(queries, " UNION ALL "))
+		if err != nil {
+			log.Warningf("Unable to get users/roles: %s", err)
+			return
+		}
+		for _, row := range res {
+			backedUp = append(backedUp, row[0].(string))
+		}
+	}
+	for _, s := range getUnownedSchemas(schemas, backedUp) {
+		log.Warningf("Schema %s is owned by %s who isn't being backed up", s.name, s.owner)
+	}
+}
+
+// Returns the schemas owned by someone other than SYS
+// who isn't amongst the given backed up users/roles.
+func getUnownedSchemas(schemas []*schema, backedUp []string) []*schema {
+	have := map[string]bool{"SYS": true}
+	for _, o := range backedUp {
+		have[o] = true
+	}
+	unowned := []*schema{}
+	for _, s := range schemas {
+		if s.owner != "" && !have[s.owner] {
+			unowned = append(unowned, s)
+		}
+	}
+	return unowned
+}
+
+func (s *schema) discovered() DiscoveredObject {
+	return DiscoveredObject{
+		Type: SCHEMAS, Schema: s.name, Owner: s.owner, RawSize: s.rawSize,
+	}
+}
+
 func addVirtualSchemaProps(conn *exasol.Conn, schemas []*schema, crit Criteria) error {
 	sql := fmt.Sprintf(`
 		SELECT schema_name AS s,
@@ -150,8 +225,9 @@ func addVirtualSchemaProps(conn *exasol.Conn, schemas []*schema, crit Criteria)
 	return nil
 }
 
-func createSchema(dst string, s *schema) error {
+func (b *backupRun) createSchema(dst string, s *schema) error {
 	log.Infof("Backing up schema %s", s.name)
+	name, _ := b.renamed(SCHEMAS, s.name, "")
 	sql := ""
 	if s.isVirtual {
 		props := ""
@@ -163,27 +239,47 @@ func createSchema(dst string, s *schema) error {
 		}
 		adapter := strings.Split(s.adapter, ".")
 		sql = fmt.Sprintf(
-			"CREATE VIRTUAL SCHEMA IF NOT EXISTS [%s]\nUSING [%s].[%s]%s;\n",
-			s.name, adapter[0], adapter[1], props,
+			"CREATE VIRTUAL SCHEMA IF NOT EXISTS %s\nUSING %s.%s%s;\n",
+			b.qb(name), b.qb(adapter[0]), b.qb(adapter[1]), props,
 		)
 	} else {
-		sql = fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS [%s];\n", s.name)
+		sql = fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;\n", b.qb(name))
 	}
 
 	if s.comment != "" {
-		sql += fmt.Sprintf("COMMENT ON SCHEMA [%s] IS '%s';\n", s.name, qStr(s.comment))
+		sql += fmt.Sprintf("COMMENT ON SCHEMA %s IS '%s';\n", b.qb(name), qStr(s.comment))
 	}
 	if s.sizeLimit > 0 {
-		sql += fmt.Sprintf("ALTER SCHEMA [%s] SET RAW_SIZE_LIMIT = %d;\n", s.name, s.sizeLimit)
+		sql += fmt.Sprintf("ALTER SCHEMA %s SET RAW_SIZE_LIMIT = %d;\n", b.qb(name), s.sizeLimit)
+	}
+	if s.owner != "" && s.owner != "SYS" {
+		// The owner has to exist first so the actual
+		// statement is backed up with the owner's user/role.
+		virtual := ""
+		if s.isVirtual {
+			virtual = "VIRTUAL "
+		}
+		sql += fmt.Sprintf(
+			"-- Owned by %s. Applied with the owner's user/role once it exists:\n"+
+				"-- ALTER %sSCHEMA %s CHANGE OWNER %s;\n",
+			s.owner, virtual, b.qb(name), b.qb(s.owner),
+		)
+	}
+
+	sql, err := b.transformDDL(SCHEMAS, s.name, "", sql)
+	if err != nil {
+		return err
 	}
 
-	dir := filepath.Join(dst, s.name)
+	dir := filepath.Join(dst, b.fileName(name))
 	os.MkdirAll(dir, os.ModePerm)
 
 	file := filepath.Join(dir, "schema.sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err = b.writeFile(file, []byte(b.fileHeader(s.name)+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup schema: %s", err)
 	}
+	b.fileWritten(file)
+	b.bundles.add(name, "schema", sql)
 	return nil
 }
@@ -2,10 +2,11 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/eddyueue/go-exasol-client"
 )
@@ -15,12 +16,20 @@ type script struct {
 	name    string
 	text    string
 	comment string
+	owner   string
 }
 
 func (s *script) Schema() string { return s.schema }
 func (s *script) Name() string   { return s.name }
 
+// The schema and name the script is backed up as
+func (s *script) dst(b *backupRun) (string, string) { return b.renamed(SCRIPTS, s.schema, s.name) }
+
 func BackupScripts(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
+	return newBackupRun().backupScripts(src, dst, crit, dropExtras)
+}
+
+func (b *backupRun) backupScripts(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Info("Backing up scripts")
 
 	scripts, dbObjs, err := getScriptsToBackup(src, crit)
@@ -28,17 +37,30 @@ func BackupScripts(src *exasol.Conn, dst string, crit Criteria, dropExtras bool)
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("scripts", dbObjs, dst, crit)
+		b.removeExtraObjects(SCRIPTS, dbObjs, dst, crit)
+	}
+	var selected []*script
+	for _, s := range scripts {
+		if b.isSelected(s.discovered()) {
+			selected = append(selected, s)
+		}
 	}
+	scripts = selected
 	if len(scripts) == 0 {
 		log.Warning("Object criteria did not match any scripts")
 		return nil
 	}
+	b.countObjects(SCRIPTS, len(scripts))
+	sort.SliceStable(scripts, func(i, j int) bool {
+		return b.schemaRank(scripts[i].schema) < b.schemaRank(scripts[j].schema)
+	})
+	checkScriptLanguages(src, scripts)
 
 	for _, s := range scripts {
-		dir := filepath.Join(dst, "schemas", s.schema, "scripts")
+		schema, _ := s.dst(b)
+		dir := filepath.Join(dst, "schemas", b.fileName(schema), "scripts")
 		os.MkdirAll(dir, os.ModePerm)
-		err = backupScript(dir, s)
+		err = b.backupScript(dir, s)
 		if err != nil {
 			return err
 		}
@@ -53,7 +75,8 @@ func getScriptsToBackup(conn *exasol.Conn, crit Criteria) ([]*script, []dbObj, e
 		SELECT script_schema AS s,
 			   script_name   AS o,
 			   script_text,
-			   script_comment
+			   script_comment,
+			   script_owner
 		FROM exa_all_scripts
 		WHERE %s
 		ORDER BY local.s, local.o
@@ -74,28 +97,106 @@ func getScriptsToBackup(conn *exasol.Conn, crit Criteria) ([]*script, []dbObj, e
 		if row[3] != nil {
 			s.comment = row[3].(string)
 		}
+		if row[4] != nil {
+			s.owner = row[4].(string)
+		}
 		scripts = append(scripts, s)
 		dbObjs = append(dbObjs, s)
 	}
 	return scripts, dbObjs, nil
 }
 
-func backupScript(dst string, s *script) error {
+func (s *script) discovered() DiscoveredObject {
+	return DiscoveredObject{Type: SCRIPTS, Schema: s.schema, Name: s.name, Owner: s.owner}
+}
+
+var scriptLanguageRE = regexp.MustCompile(`^(?is)\s*CREATE\s+(?:OR\s+REPLACE\s+)?(\w+)\s+(?:SCALAR|SET|ADAPTER)\s+SCRIPT\b`)
+
+// Returns the language alias a UDF/adapter script is written in
+// ("" for scripting programs which have none).
+func getScriptLanguage(text string) string {
+	m := scriptLanguageRE.FindStringSubmatch(text)
+	if m == nil {
+		return ""
+	}
+	return strings.ToUpper(m[1])
+}
+
+// The UDF languages are registered as aliases in the SCRIPT_LANGUAGES
+// parameter (backed up to parameters.sql) which has to be applied before
+// any of the scripts using them. This warns about scripts whose language
+// isn't registered at all as they couldn't be run once restored.
+func checkScriptLanguages(conn *exasol.Conn, scripts []*script) {
+	res, err := conn.FetchSlice(`
+		SELECT system_value
+		FROM exa_parameters
+		WHERE parameter_name = 'SCRIPT_LANGUAGES'
+	`)
+	if err != nil {
+		log.Warningf("Unable to get script languages: %s", err)
+		return
+	}
+	var scriptLanguages string
+	if len(res) > 0 && res[0][0] != nil {
+		scriptLanguages = res[0][0].(string)
+	}
+	for _, s := range getUnregisteredLanguages(scripts, scriptLanguages) {
+		log.Warningf(
+			"Script %s.%s uses language %s which isn't registered in SCRIPT_LANGUAGES",
+			s.schema, s.name, getScriptLanguage(s.text),
+		)
+	}
+}
+
+// Returns the scripts using a language alias which isn't
+// registered in the given SCRIPT_LANGUAGES value.
+func getUnregisteredLanguages(scripts []*script, scriptLanguages string) []*script {
+	registered := map[string]bool{"LUA": true} // Lua is built in
+	for _, l := range strings.Fields(scriptLanguages) {
+		alias := strings.SplitN(l, "=", 2)[0]
+		registered[strings.ToUpper(alias)] = true
+	}
+	unregistered := []*script{}
+	for _, s := range scripts {
+		lang := getScriptLanguage(s.text)
+		if lang != "" && !registered[lang] {
+			unregistered = append(unregistered, s)
+		}
+	}
+	return unregistered
+}
+
+func (b *backupRun) backupScript(dst string, s *script) error {
 	log.Infof("Backing up script %s.%s", s.schema, s.name)
-	sText := regexp.MustCompile(`^CREATE `).
-		ReplaceAllString(s.text, "CREATE OR REPLACE ")
-	sql := fmt.Sprintf("OPEN SCHEMA [%s];\n--/\n%s\n/\n", s.schema, sText)
+	schema, name := s.dst(b)
+	sText := s.text
+	if schema != s.schema || name != s.name {
+		sText = regexp.MustCompile(`^(?is)(CREATE\s.*?SCRIPT\s+)("?[\w_-]+"?\.)?"?[\w_-]+"?`).
+			ReplaceAllString(sText, "${1}"+strings.ReplaceAll(b.qd(schema)+"."+b.qd(name), "$", "$$"))
+	}
+	// Only the CREATE is touched. The rest of the text (e.g. the
+	// parameters and RETURNS clause) is backed up as the catalog has it.
+	sText = regexp.MustCompile(`^(?i)CREATE\s+(OR\s+REPLACE\s+)?`).
+		ReplaceAllString(sText, "CREATE OR REPLACE ")
+	sql := fmt.Sprintf("OPEN SCHEMA %s;\n--/\n%s\n/\n", b.qb(schema), sText)
 	if s.comment != "" {
 		sql += fmt.Sprintf(
-			"COMMENT ON SCRIPT [%s].[%s] IS '%s';\n",
-			s.schema, s.name, qStr(s.comment),
+			"COMMENT ON SCRIPT %s.%s IS '%s';\n",
+			b.qb(schema), b.qb(name), qStr(s.comment),
 		)
 	}
 
-	file := filepath.Join(dst, s.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	sql, err := b.transformDDL(SCRIPTS, s.schema, s.name, sql)
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(dst, b.fileName(name)+".sql")
+	err = b.writeFile(file, []byte(b.fileHeader(s.schema+"."+s.name)+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup script: %s", err)
 	}
+	b.fileWritten(file)
+	b.bundles.add(schema, "scripts", sql)
 	return nil
 }
@@ -0,0 +1,174 @@
+package backup
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/eddyueue/go-exasol-client"
+)
+
+// This sets up the session used for data exports and backs up
+// the settings so that the CSVs can be loaded back under the same ones.
+
+var defaultExportNLS = map[string]string{
+	"NLS_DATE_FORMAT":        "YYYY-MM-DD",
+	"NLS_TIMESTAMP_FORMAT":   "YYYY-MM-DD HH24:MI:SS.FF3",
+	"NLS_NUMERIC_CHARACTERS": ".,",
+}
+
+func getExportNLS(exportNLS map[string]string) map[string]string {
+	nls := map[string]string{}
+	for name, value := range defaultExportNLS {
+		nls[name] = value
+	}
+	for name, value := range exportNLS {
+		nls[strings.ToUpper(name)] = value
+	}
+	return nls
+}
+
+// This returns a func which puts the session's settings back
+// to what they were so the caller's connection is left as is.
+func setExportSession(conn *exasol.Conn, exportNLS map[string]string, timeZone string) (func(), error) {
+	nls := getExportNLS(exportNLS)
+	nls["TIME_ZONE"] = timeZone
+	restore, err := saveSession(conn, sortedKeys(nls))
+	if err != nil {
+		return nil, err
+	}
+	if timeZone == "" {
+		// Default to the database's time zone rather than
+		// whatever the connection's session may have set.
+		res, err := conn.FetchSlice(`
+			SELECT system_value
+			FROM exa_parameters
+			WHERE parameter_name = 'TIME_ZONE'
+		`)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get database time zone: %s", err)
+		}
+		nls["TIME_ZONE"] = res[0][0].(string)
+	}
+	for _, name := range sortedKeys(nls) {
+		sql := fmt.Sprintf("ALTER SESSION SET %s=%s", name, parameterValue(name, nls[name]))
+		_, err := conn.Execute(sql)
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("Unable to set session %s: %s", name, err)
+		}
+	}
+	return restore, nil
+}
+
+// Captures the session's current values of the parameters
+// and returns a func which sets them back to those values.
+func saveSession(conn *exasol.Conn, names []string) (func(), error) {
+	var quoted []string
+	for _, name := range names {
+		quoted = append(quoted, "'"+qStr(name)+"'")
+	}
+	res, err := conn.FetchSlice(fmt.Sprintf(`
+		SELECT parameter_name,
+			   session_value
+		FROM exa_parameters
+		WHERE parameter_name IN (%s)
+		ORDER BY parameter_name
+		`, strings.Join(quoted, ","),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get session settings: %s", err)
+	}
+	return func() {
+		for _, row := range res {
+			if row[1] == nil {
+				continue
+			}
+			name := row[0].(string)
+			sql := fmt.Sprintf("ALTER SESSION SET %s=%s", name, parameterValue(name, row[1].(string)))
+			_, err := conn.Execute(sql)
+			if err != nil {
+				log.Warningf("Unable to restore session %s: %s", name, err)
+			}
+		}
+	}, nil
+}
+
+// Exasol aborts any query running longer than the session's QUERY_TIMEOUT.
+// This sets it to ObjectTimeout for a data query and returns a func which
+// puts the session's own QUERY_TIMEOUT back once that query is done, so
+// that the rest of the backup isn't subject to it.
+func (b *backupRun) setObjectTimeout(conn *exasol.Conn) (func(), error) {
+	if b.option.objectTimeout <= 0 {
+		return func() {}, nil
+	}
+	reset, err := saveSession(conn, []string{"QUERY_TIMEOUT"})
+	if err != nil {
+		return nil, err
+	}
+	secs := int(math.Ceil(b.option.objectTimeout.Seconds()))
+	_, err = conn.Execute(fmt.Sprintf("ALTER SESSION SET QUERY_TIMEOUT=%d", secs))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set session QUERY_TIMEOUT: %s", err)
+	}
+	return reset, nil
+}
+
+func BackupSession(src *exasol.Conn, dst string, exportNLS map[string]string) error {
+	return newBackupRun().backupSession(src, dst, exportNLS)
+}
+
+func (b *backupRun) backupSession(src *exasol.Conn, dst string, exportNLS map[string]string) error {
+	log.Info("Backing up export session settings")
+
+	// The time zone is needed to correctly load
+	// TIMESTAMP WITH LOCAL TIME ZONE data.
+	names := []string{"'TIME_ZONE'"}
+	for _, name := range sortedKeys(getExportNLS(exportNLS)) {
+		names = append(names, "'"+qStr(name)+"'")
+	}
+	sql := fmt.Sprintf(`
+		SELECT parameter_name,
+			   session_value
+		FROM exa_parameters
+		WHERE parameter_name IN (%s)
+		ORDER BY parameter_name
+		`, strings.Join(names, ","),
+	)
+	res, err := src.FetchSlice(sql)
+	if err != nil {
+		return fmt.Errorf("Unable to get session settings: %s", err)
+	}
+
+	var out string
+	for _, row := range res {
+		if row[1] == nil {
+			continue
+		}
+		out += fmt.Sprintf(
+			"ALTER SESSION SET %s='%s';\n",
+			row[0].(string), qStr(row[1].(string)),
+		)
+	}
+
+	os.MkdirAll(dst, os.ModePerm)
+	file := filepath.Join(dst, "session.sql")
+	err = b.writeFile(file, []byte(b.fileHeader("session")+out))
+	if err != nil {
+		return fmt.Errorf("Unable to backup session settings: %s", err)
+	}
+	b.fileWritten(file)
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
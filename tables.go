@@ -1,11 +1,14 @@
 package backup
 
 import (
+	"encoding/csv"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,11 +21,19 @@ type table struct {
 	name         string
 	rowCount     float64
 	columns      []*column
+	dataColumns  []*column // In DataColumnOrder
 	constraints  []*constraint
 	distribution []string
 	partition    []string
 	data         chan []byte
 	comment      string
+	warnings     []string // About the data recorded in the manifest
+	owner        string
+	rawSize      int64
+	missing      bool
+	resumed      bool
+	failed       bool
+	empty        bool // If the export returned no rows and it was skipped
 }
 
 type column struct {
@@ -46,15 +57,29 @@ type constraint struct {
 func (t *table) Schema() string { return t.schema }
 func (t *table) Name() string   { return t.name }
 
-func BackupTables(src *exasol.Conn, dst string, crit Criteria, maxRows int, dropExtras bool) error {
+// The schema and name the table is backed up as
+func (t *table) dst(b *backupRun) (string, string) { return b.renamed(TABLES, t.schema, t.name) }
+
+// The data file's path relative to the destination
+func (t *table) dataFile(b *backupRun) string {
+	schema, name := t.dst(b)
+	return filepath.Join("schemas", b.fileName(schema), "tables", b.fileName(name)+".csv")
+}
+
+func BackupTables(src *exasol.Conn, dst string, crit Criteria, maxRows int, dataWhere map[string]string, dropExtras bool) error {
+	return newBackupRun().backupTables(src, dst, crit, maxRows, dataWhere, dropExtras)
+}
+
+func (b *backupRun) backupTables(src *exasol.Conn, dst string, crit Criteria, maxRows int, dataWhere map[string]string, dropExtras bool) error {
 	log.Info("Backing up tables")
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
 	tables := make(chan *table, 10)
 	errors := make(chan error, 2)
-	go readTables(src, tables, crit, maxRows, dst, dropExtras, errors, wg)
-	go writeTables(dst, tables, crit, maxRows, errors, wg)
+	stop := make(chan struct{}) // Closed if the writer fails
+	go b.readTables(src, tables, crit, maxRows, dataWhere, dst, dropExtras, stop, errors, wg)
+	go b.writeTables(dst, tables, crit, maxRows, stop, errors, wg)
 
 	wg.Wait()
 	log.Info("Done backing up tables")
@@ -66,7 +91,7 @@ func BackupTables(src *exasol.Conn, dst string, crit Criteria, maxRows int, drop
 	}
 }
 
-func readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, maxRows int, dst string, dropExtras bool, errors chan<- error, wg *sync.WaitGroup) {
+func (b *backupRun) readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, maxRows int, dataWhere map[string]string, dst string, dropExtras bool, stop <-chan struct{}, errors chan<- error, wg *sync.WaitGroup) {
 	defer func() {
 		close(out)
 		wg.Done()
@@ -78,12 +103,15 @@ func readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, maxRows int
 		return
 	}
 	if dropExtras {
-		removeExtraObjects("tables", dbObjs, dst, crit)
+		b.removeExtraObjects(TABLES, dbObjs, dst, crit)
 	}
 	if len(tables) == 0 {
 		log.Warning("Object criteria did not match any tables")
 		return
 	}
+	sort.SliceStable(tables, func(i, j int) bool {
+		return b.schemaRank(tables[i].schema) < b.schemaRank(tables[j].schema)
+	})
 
 	err = addTableColumns(conn, tables, crit)
 	if err != nil {
@@ -95,9 +123,27 @@ func readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, maxRows int
 		errors <- err
 		return
 	}
+	var selected []*table
+	for _, t := range tables {
+		if b.isSelected(t.discovered()) {
+			selected = append(selected, t)
+		}
+	}
+	tables = selected
+	b.countObjects(TABLES, len(tables))
 
 	for _, table := range tables {
-		err = readTable(conn, table, out, maxRows)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		tableMaxRows := b.getTableMaxRows(table, maxRows)
+		if dropExtras && tableMaxRows > 0 && table.rowCount == 0 {
+			// Remove any data backed up before the table was emptied
+			removeDataFiles(filepath.Join(dst, table.dataFile(b)))
+		}
+		err = b.readTable(conn, table, out, tableMaxRows, dataWhere)
 		if err != nil {
 			errors <- err
 			return
@@ -105,9 +151,32 @@ func readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, maxRows int
 	}
 }
 
-func readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int) error {
+func (b *backupRun) readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int, dataWhere map[string]string) error {
 	log.Infof("Backing up %s.%s", t.schema, t.name)
-	if t.rowCount == 0 || t.rowCount > float64(maxRows) {
+	if !b.shouldBackupTableData(t, maxRows) {
+		out <- t
+		return nil
+	}
+	var err error
+	t.dataColumns, err = b.getDataColumns(t)
+	if err != nil {
+		return err
+	}
+	// Explicitly list the columns (rather than SELECT *) so that the CSV
+	// column order is guaranteed to match the column order of the DDL
+	// (or the DataColumnOrder).
+	var cols []Column
+	for _, col := range t.dataColumns {
+		cols = append(cols, Column{Name: col.name, Type: col.colType})
+	}
+	selectList, warnings, err := b.getDataSelectList(t.schema, t.name, cols)
+	if err != nil {
+		return err
+	}
+	t.warnings = warnings
+	if b.progress.isDone(t.dataFile(b)) {
+		log.Infof("Skipping already backed up data for %s.%s", t.schema, t.name)
+		t.resumed = true
 		out <- t
 		return nil
 	}
@@ -120,24 +189,52 @@ func readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int) erro
 			orderBys = cnst.columns
 		}
 	}
+	var colNames []string
+	for _, col := range t.columns {
+		colNames = append(colNames, col.name)
+	}
 	if len(orderBys) == 0 {
-		for _, col := range t.columns {
-			orderBys = append(orderBys, col.name)
-		}
+		orderBys = colNames
 	}
 	exportSQL := fmt.Sprintf(
-		"EXPORT (SELECT * FROM [%s].[%s] ORDER BY [%s]) INTO CSV AT '%%s' FILE 'data.csv'",
-		t.schema, t.name, strings.Join(orderBys, `],[`),
+		"EXPORT (%s) INTO CSV AT '%%s' FILE 'data.csv'%s",
+		b.getTableDataQuery(
+			t, selectList, getDataWhereClause(dataWhere, colNames),
+			bracketList(orderBys), maxRows,
+		),
+		b.getDataExportHint(t.schema, t.name),
 	)
 
 	start := time.Now()
-	res := conn.StreamQuery(exportSQL)
+	resetTimeout, err := b.setObjectTimeout(conn)
+	if err != nil {
+		t.failed = true
+		close(t.data)
+		return err
+	}
+	res := streamQuery(conn, exportSQL)
 	if res.Error != nil {
+		resetTimeout()
+		if b.isMissingObject(conn, t.schema, t.name) {
+			log.Warningf("Skipping %s.%s which no longer exists", t.schema, t.name)
+			t.missing = true
+			close(t.data)
+			return nil
+		}
+		if !b.option.strict && b.isTimeoutError(res.Error) {
+			log.Warningf("Skipping data of %s.%s which took longer than %s", t.schema, t.name, b.option.objectTimeout)
+			t.failed = true
+			close(t.data)
+			return nil
+		}
+		t.failed = true
+		close(t.data)
 		return fmt.Errorf("Unable to read table %s.%s: %s", t.schema, t.name, res.Error)
 	}
 	for d := range res.Data {
 		t.data <- d
 	}
+	resetTimeout()
 	close(t.data)
 	duration := time.Since(start).Seconds()
 
@@ -148,6 +245,103 @@ func readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int) erro
 	return nil
 }
 
+// Returns the table's columns in the order its data is backed up in.
+// That's the DDL's order unless the table has a DataColumnOrder.
+func (b *backupRun) getDataColumns(t *table) ([]*column, error) {
+	order, ok := b.option.dataColumnOrder[t.schema+"."+t.name]
+	if !ok {
+		return t.columns, nil
+	}
+	var cols []*column
+	listed := map[*column]bool{}
+	for _, name := range order {
+		var col *column
+		for _, c := range t.columns {
+			if strings.EqualFold(c.name, name) {
+				col = c
+			}
+		}
+		if col == nil {
+			return nil, fmt.Errorf(
+				"The DataColumnOrder for %s.%s has unknown column %s",
+				t.schema, t.name, name,
+			)
+		}
+		if !listed[col] {
+			cols = append(cols, col)
+			listed[col] = true
+		}
+	}
+	if !b.option.dataColumnOrderOnly {
+		for _, c := range t.columns {
+			if !listed[c] {
+				cols = append(cols, c)
+			}
+		}
+	}
+	return cols, nil
+}
+
+const unlimitedRows = int(^uint(0) >> 1)
+
+// Returns the table's row limit from TableRowLimits, if any,
+// otherwise the global MaxTableRows
+func (b *backupRun) getTableMaxRows(t *table, maxRows int) int {
+	limit, ok := b.option.tableRowLimits[t.schema+"."+t.name]
+	if !ok {
+		return maxRows
+	}
+	if limit < 0 {
+		return unlimitedRows
+	}
+	return limit
+}
+
+func (b *backupRun) shouldBackupTableData(t *table, maxRows int) bool {
+	return maxRows > 0 && t.rowCount > 0 &&
+		(t.rowCount <= float64(maxRows) || b.option.dataSample != NO_SAMPLE)
+}
+
+// Returns the query selecting the table's data. If the table has more
+// than maxRows rows then it's sampled according to DataSampleStrategy.
+func (b *backupRun) getTableDataQuery(t *table, selectList, where, orderBy string, maxRows int) string {
+	if t.rowCount <= float64(maxRows) || b.option.dataSample == NO_SAMPLE {
+		return fmt.Sprintf(
+			"SELECT %s FROM %s.%s%s ORDER BY %s",
+			selectList, bracket(t.schema), bracket(t.name), where, orderBy,
+		)
+	}
+	log.Infof("Sampling %d of %.0f rows of %s.%s", maxRows, t.rowCount, t.schema, t.name)
+	switch b.option.dataSample {
+	case RANDOM_ROWS:
+		return fmt.Sprintf(
+			"SELECT %s FROM (SELECT * FROM %s.%s%s ORDER BY RANDOM() LIMIT %d) ORDER BY %s",
+			selectList, bracket(t.schema), bracket(t.name), where, maxRows, orderBy,
+		)
+	case SYSTEMATIC_ROWS:
+		// The row count is only approximate when a where clause
+		// applies so the LIMIT guarantees the cap is honored.
+		k := getSampleInterval(t, maxRows)
+		return fmt.Sprintf(
+			"SELECT %s FROM ("+
+				"SELECT t.*, ROW_NUMBER() OVER (ORDER BY %s) AS backup_sample_row_ "+
+				"FROM %s.%s t%s"+
+				") WHERE MOD(backup_sample_row_ - 1, %d) = 0 ORDER BY %s LIMIT %d",
+			selectList, orderBy, bracket(t.schema), bracket(t.name), where, k, orderBy, maxRows,
+		)
+	default: // FIRST_ROWS
+		return fmt.Sprintf(
+			"SELECT %s FROM %s.%s%s ORDER BY %s LIMIT %d",
+			selectList, bracket(t.schema), bracket(t.name), where, orderBy, maxRows,
+		)
+	}
+}
+
+// Returns k where SYSTEMATIC_ROWS samples every k-th row
+func getSampleInterval(t *table, maxRows int) int {
+	return int(math.Ceil(t.rowCount / float64(maxRows)))
+}
+
 func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, error) {
 	sql := fmt.Sprintf(`
 		SELECT table_schema AS s,
@@ -155,8 +349,14 @@ func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, err
 			   table_row_count,
 			   table_comment,
 			   distribution,
-			   partition
+			   partition,
+			   table_owner,
+			   raw_object_size
 		FROM exa_all_tables
+		LEFT JOIN exa_all_object_sizes AS os
+		  ON os.root_name = table_schema
+		 AND os.object_name = table_name
+		 AND os.object_type = 'TABLE'
 		LEFT JOIN (
 			SELECT column_schema AS s,
 				   column_table  AS o,
@@ -210,12 +410,25 @@ func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, err
 		if row[5] != nil {
 			t.partition = strings.Split(row[5].(string), ",")
 		}
+		if row[6] != nil {
+			t.owner = row[6].(string)
+		}
+		if row[7] != nil {
+			t.rawSize = int64(row[7].(float64))
+		}
 		tables = append(tables, t)
 		dbObjs = append(dbObjs, t)
 	}
 	return tables, dbObjs, nil
 }
 
+func (t *table) discovered() DiscoveredObject {
+	return DiscoveredObject{
+		Type: TABLES, Schema: t.schema, Name: t.name, Owner: t.owner,
+		Rows: t.rowCount, RawSize: t.rawSize,
+	}
+}
+
 func addTableColumns(conn *exasol.Conn, tables []*table, crit Criteria) error {
 	sql := fmt.Sprintf(`
 		SELECT column_schema AS s,
@@ -238,6 +451,9 @@ func addTableColumns(conn *exasol.Conn, tables []*table, crit Criteria) error {
 	for _, row := range res {
 		schemaName := row[0].(string)
 		tableName := row[1].(string)
+		// column_type is the full type including any size, precision
+		// or SRID, e.g. GEOMETRY(4326). Exasol's spatial reference
+		// systems are built-in so there's nothing else to back up.
 		col := &column{
 			name:    row[2].(string),
 			colType: row[3].(string),
@@ -344,126 +560,334 @@ func addTableConstraints(conn *exasol.Conn, tables []*table, crit Criteria) erro
 	return nil
 }
 
-func writeTables(dst string, in <-chan *table, crit Criteria, maxRows int, errors chan<- error, wg *sync.WaitGroup) {
+func (b *backupRun) writeTables(dst string, in <-chan *table, crit Criteria, maxRows int, stop chan<- struct{}, errors chan<- error, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	fail := func(t *table, err error) {
+		errors <- err
+		close(stop)
+		// Keep consuming so the reader isn't left blocked
+		discardTableData(t)
+		for t := range in {
+			discardTableData(t)
+		}
+	}
+
+	fkSQL := map[string]string{} // schema -> deferred foreign keys
 	for t := range in {
-		dir := filepath.Join(dst, "schemas", t.schema, "tables")
+		dstSchema, dstName := t.dst(b)
+		dir := filepath.Join(dst, "schemas", b.fileName(dstSchema), "tables")
 		os.MkdirAll(dir, os.ModePerm)
-		err := createTable(dir, t)
+		err := b.createTable(dir, t)
 		if err != nil {
-			errors <- err
+			fail(t, err)
 			return
 		}
-		err = writeTableData(dir, t, maxRows)
-		if err != nil {
-			errors <- err
-			return
+		if b.option.dataSink != nil {
+			err = b.sinkTableData(t, b.getTableMaxRows(t, maxRows))
+			if err != nil {
+				fail(t, err)
+				return
+			}
+		} else if !t.resumed {
+			err = b.writeTableData(dir, t, b.getTableMaxRows(t, maxRows))
+			if err != nil {
+				fail(t, err)
+				return
+			}
+		}
+		if t.missing {
+			os.Remove(filepath.Join(dir, b.fileName(dstName)+".sql"))
+			removeDataFiles(filepath.Join(dir, b.fileName(dstName)+".csv"))
+		} else {
+			if b.bundles != nil {
+				tableSQL, err := b.transformDDL(TABLES, t.schema, t.name, b.getTableSQL(t, false))
+				if err != nil {
+					fail(t, err)
+					return
+				}
+				b.bundles.add(dstSchema, "tables", tableSQL)
+				b.bundles.add(dstSchema, "constraints", b.getForeignKeysSQL(t))
+			}
+			b.noteTableData(t, b.getTableMaxRows(t, maxRows))
+			if b.option.deferConstraints {
+				fkSQL[dstSchema] += b.getForeignKeysSQL(t)
+			}
 		}
 		t.data = nil // otherwise seems to leak mem
 	}
 
-	wg.Done()
+	for schemaName, sql := range fkSQL {
+		file := filepath.Join(dst, "schemas", b.fileName(schemaName), "constraints.sql")
+		if sql == "" {
+			os.Remove(file)
+			continue
+		}
+		err := b.writeFile(file, []byte(b.fileHeader(schemaName)+sql))
+		if err != nil {
+			errors <- fmt.Errorf("Unable to backup constraints of %s: %s", schemaName, err)
+			return
+		}
+		b.fileWritten(file)
+	}
 }
 
-func createTable(dir string, t *table) error {
-	sysConstraint := regexp.MustCompile(`SYS_\d+`)
-	var cols []string
-	for _, c := range t.columns {
-		col := fmt.Sprintf(`"%s" %s`, c.name, c.colType)
-		if c.colDefault != "" {
-			col += fmt.Sprintf(" DEFAULT %s", c.colDefault)
-		}
-		if c.identity != "" {
-			col += fmt.Sprintf(" IDENTITY %s", c.identity)
-		}
-		// in-line constraints
-		for _, cnst := range t.constraints {
-			if cnst.conType == "NOT NULL" &&
-				cnst.columns[0] == c.name {
-				if cnst.name != "" && !sysConstraint.MatchString(cnst.name) {
-					col += fmt.Sprintf(` CONSTRAINT "%s"`, cnst.name)
-				}
-				col += " NOT NULL"
-				if !cnst.enabled {
-					col += " DISABLE"
-				}
-				break
+// Feeds the table's data to the DataSink rather than to a CSV file
+func (b *backupRun) sinkTableData(t *table, maxRows int) error {
+	if !b.shouldBackupTableData(t, maxRows) {
+		return nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for d := range t.data {
+			// This only fails if the parsing below stopped early
+			// in which case the rest of the data is discarded.
+			pw.Write(d)
+		}
+		pw.Close()
+	}()
+
+	rows := make(chan []string, 1000)
+	var parseErr error
+	go func() {
+		defer close(rows)
+		r := csv.NewReader(pr)
+		r.FieldsPerRecord = -1
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				parseErr = err
+				pr.Close()
+				return
 			}
+			rows <- row
+		}
+	}()
+
+	var header []string
+	for _, c := range t.dataColumns {
+		header = append(header, c.name)
+	}
+	err := b.option.dataSink(t.schema, t.name, header, rows)
+	// Keep consuming in case the sink stopped early
+	for range rows {
+	}
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to sink data of %s.%s: %s", t.schema, t.name, err)
+	}
+	if parseErr != nil && !t.missing && !t.failed {
+		return fmt.Errorf("Unable to parse data of %s.%s: %s", t.schema, t.name, parseErr)
+	}
+	return nil
+}
+
+// Records in the manifest what a restore can't tell from the
+// table's data files, e.g. that they're a sample or why there are none.
+func (b *backupRun) noteTableData(t *table, maxRows int) {
+	if !b.option.tableData || b.option.dataSink != nil {
+		return
+	}
+	d := &dataManifest{}
+	switch {
+	case t.failed:
+		d.Skipped = skippedTimeout
+	case t.empty || t.rowCount == 0:
+		d.Empty = true
+	case !b.shouldBackupTableData(t, maxRows):
+		d.Skipped = skippedRowLimit
+	case t.rowCount > float64(maxRows):
+		d.Sample = &sampleManifest{
+			Strategy:  dataSampleNames[b.option.dataSample],
+			Rows:      maxRows,
+			TableRows: int64(t.rowCount),
 		}
-		if c.comment != "" {
-			col += fmt.Sprintf(" COMMENT IS '%s'", qStr(c.comment))
+		if b.option.dataSample == SYSTEMATIC_ROWS {
+			d.Sample.Every = getSampleInterval(t, maxRows)
 		}
-		cols = append(cols, col)
+	}
+	if !d.Empty && d.Skipped == "" {
+		d.Warnings = t.warnings
+	}
+	b.manifest.noteData(t.dataFile(b), d)
+}
+
+func discardTableData(t *table) {
+	if t.data != nil {
+		for range t.data {
+		}
+	}
+}
+
+func (b *backupRun) createTable(dir string, t *table) error {
+	sql, err := b.transformDDL(TABLES, t.schema, t.name, b.getTableSQL(t, !b.option.deferConstraints))
+	if err != nil {
+		return err
+	}
+	_, name := t.dst(b)
+	file := filepath.Join(dir, b.fileName(name)+".sql")
+
+	err = b.writeFile(file, []byte(b.fileHeader(t.schema+"."+t.name)+sql))
+	if err != nil {
+		return fmt.Errorf("Unable to backup table %s.%s: %s", t.schema, t.name, err)
+	}
+	b.fileWritten(file)
+	return nil
+}
+
+// If withFKs is false then the foreign keys are left out
+// so they can be added separately via getForeignKeysSQL
+func (b *backupRun) getTableSQL(t *table, withFKs bool) string {
+	var cols []string
+	for _, c := range t.columns {
+		cols = append(cols, b.getColumnSQL(t, c))
 	}
 
 	// out-of-line constraints
 	for _, cnst := range t.constraints {
-		if cnst.conType == "NOT NULL" {
+		if cnst.conType == "NOT NULL" ||
+			(cnst.conType == "FOREIGN KEY" && !withFKs) {
 			continue
 		}
-		col := ""
-		if cnst.name != "" && !sysConstraint.MatchString(cnst.name) {
-			col += fmt.Sprintf(`CONSTRAINT "%s" `, cnst.name)
-		}
-		col += fmt.Sprintf(
-			`%s ("%s")`,
-			cnst.conType, strings.Join(cnst.columns, `","`),
-		)
-		if cnst.conType == "FOREIGN KEY" {
-			col += fmt.Sprintf(
-				` REFERENCES "%s"."%s" ("%s")`,
-				cnst.refSchema, cnst.refTable,
-				strings.Join(cnst.refColumns, `","`),
-			)
-		}
-		if !cnst.enabled {
-			col += " DISABLE"
-		}
-		cols = append(cols, col)
+		cols = append(cols, b.getConstraintSQL(cnst))
 	}
 
 	if len(t.distribution) > 0 {
 		cols = append(cols,
-			fmt.Sprintf(`DISTRIBUTE BY "%s"`, strings.Join(t.distribution, `","`)),
+			"DISTRIBUTE BY "+b.qdList(t.distribution),
 		)
 	}
 	if len(t.partition) > 0 {
 		cols = append(cols,
-			fmt.Sprintf(`PARTITION BY "%s"`, strings.Join(t.partition, `","`)),
+			"PARTITION BY "+b.qdList(t.partition),
 		)
 	}
 
+	schema, name := t.dst(b)
 	sql := fmt.Sprintf(
-		"CREATE OR REPLACE TABLE \"%s\".\"%s\" (\n\t%s\n)",
-		t.schema, t.name, strings.Join(cols, ",\n\t"),
+		"CREATE OR REPLACE TABLE %s.%s (\n\t%s\n)",
+		b.qd(schema), b.qd(name), strings.Join(cols, ",\n\t"),
 	)
 	if t.comment != "" {
 		sql += fmt.Sprintf(" COMMENT IS '%s'", qStr(t.comment))
 	}
 	sql += ";\n"
-	file := filepath.Join(dir, t.name+".sql")
+	return sql
+}
 
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
-	if err != nil {
-		return fmt.Errorf("Unable to backup table %s.%s: %s", t.schema, t.name, err)
+// The clauses are always in the order of Exasol's column definition
+// syntax: type, IDENTITY start or DEFAULT (a column can't have both),
+// the NOT NULL constraint (with its name and state) and the COMMENT.
+func (b *backupRun) getColumnSQL(t *table, c *column) string {
+	sysConstraint := regexp.MustCompile(`SYS_\d+`)
+	col := fmt.Sprintf(`%s %s`, b.qd(c.name), c.colType)
+	if c.identity != "" {
+		col += fmt.Sprintf(" IDENTITY %s", c.identity)
 	}
-	return nil
+	if c.colDefault != "" {
+		col += fmt.Sprintf(" DEFAULT %s", c.colDefault)
+	}
+	// in-line constraints
+	for _, cnst := range t.constraints {
+		if cnst.conType == "NOT NULL" &&
+			cnst.columns[0] == c.name {
+			if cnst.name != "" && !sysConstraint.MatchString(cnst.name) {
+				col += fmt.Sprintf(` CONSTRAINT %s`, b.qd(cnst.name))
+			}
+			col += " NOT NULL" + getConstraintState(cnst)
+			break
+		}
+	}
+	if c.comment != "" {
+		col += fmt.Sprintf(" COMMENT IS '%s'", qStr(c.comment))
+	}
+	return col
 }
 
-func writeTableData(dir string, t *table, maxRows int) error {
-	if t.rowCount == 0 || t.rowCount > float64(maxRows) {
-		return nil
+func (b *backupRun) getForeignKeysSQL(t *table) string {
+	schema, name := t.dst(b)
+	sql := ""
+	for _, cnst := range t.constraints {
+		if cnst.conType == "FOREIGN KEY" {
+			sql += fmt.Sprintf(
+				"ALTER TABLE %s.%s ADD %s;\n",
+				b.qd(schema), b.qd(name), b.getConstraintSQL(cnst),
+			)
+		}
 	}
-	fp := filepath.Join(dir, t.name+".csv")
-	f, err := os.Create(fp)
-	if err != nil {
-		return fmt.Errorf("Unable to create file %s: %s", fp, err)
+	return sql
+}
+
+func (b *backupRun) getConstraintSQL(cnst *constraint) string {
+	sysConstraint := regexp.MustCompile(`SYS_\d+`)
+	sql := ""
+	if cnst.name != "" && !sysConstraint.MatchString(cnst.name) {
+		sql += fmt.Sprintf(`CONSTRAINT %s `, b.qd(cnst.name))
+	}
+	sql += fmt.Sprintf(
+		`%s (%s)`,
+		cnst.conType, b.qdList(cnst.columns),
+	)
+	if cnst.conType == "FOREIGN KEY" {
+		refSchema, refTable := b.renamed(TABLES, cnst.refSchema, cnst.refTable)
+		sql += fmt.Sprintf(
+			` REFERENCES %s.%s (%s)`,
+			b.qd(refSchema), b.qd(refTable), b.qdList(cnst.refColumns),
+		)
+	}
+	sql += getConstraintState(cnst)
+	return sql
+}
+
+// The state is always explicit so that the target's
+// CONSTRAINT_STATE_DEFAULT doesn't affect the restore.
+func getConstraintState(cnst *constraint) string {
+	if cnst.enabled {
+		return " ENABLE"
+	}
+	return " DISABLE"
+}
+
+func (b *backupRun) writeTableData(dir string, t *table, maxRows int) error {
+	if !b.shouldBackupTableData(t, maxRows) {
+		return nil
 	}
+	_, name := t.dst(b)
+	fp := filepath.Join(dir, b.fileName(name)+".csv")
+	w := b.newCSVWriter(fp, b.getCSVFormat(t.schema, t.name))
+	var err error
 	for d := range t.data {
-		_, err = f.Write(d)
+		_, err = w.Write(d)
 		if err != nil {
-			return fmt.Errorf("Unable to write to file %s: %s", fp, err)
+			break
 		}
 	}
-	f.Close()
-	return nil
+	if err != nil {
+		// Don't leave a partially written file behind
+		w.Abort()
+		return fmt.Errorf("Unable to write to file %s: %s", fp, err)
+	}
+	if t.missing || t.failed {
+		// Keep the previous backup's data rather than a partial export
+		w.Abort()
+		return nil
+	}
+	if w.size == 0 && b.option.skipEmptyData {
+		log.Infof("Skipping empty data for %s.%s", t.schema, t.name)
+		w.Abort()
+		removeDataFiles(fp)
+		t.empty = true
+		return nil
+	}
+	err = w.Commit()
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("Unable to write to file %s: %s", fp, err)
+	}
+	for _, f := range b.dataFiles(fp) {
+		b.fileWritten(f)
+	}
+	return b.progress.markDone(t.dataFile(b))
 }
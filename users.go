@@ -2,7 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -21,6 +20,10 @@ type user struct {
 }
 
 func BackupUsers(src *exasol.Conn, dst string, dropExtras bool) error {
+	return newBackupRun().backupUsers(src, dst, dropExtras)
+}
+
+func (b *backupRun) backupUsers(src *exasol.Conn, dst string, dropExtras bool) error {
 	log.Info("Backing up users")
 
 	users, err := getUsersToBackup(src)
@@ -31,6 +34,7 @@ func BackupUsers(src *exasol.Conn, dst string, dropExtras bool) error {
 		log.Warning("No users found")
 		return nil
 	}
+	b.countObjects(USERS, len(users))
 
 	dir := filepath.Join(dst, "users")
 	if dropExtras {
@@ -40,18 +44,21 @@ func BackupUsers(src *exasol.Conn, dst string, dropExtras bool) error {
 	os.MkdirAll(dir, os.ModePerm)
 
 	var userNames []string
+	groups := map[string]string{}
 	for _, user := range users {
-		err = backupUser(dir, user)
-		if err != nil {
-			return err
-		}
 		userNames = append(userNames, user.name)
+		groups[user.name] = b.getGroupSQL("USER", user.name, user.consumerGroup)
 	}
-
-	err = BackupPrivileges(src, dir, userNames)
+	privs, err := b.getPrivileges(src, userNames, groups)
 	if err != nil {
 		return err
 	}
+	for _, user := range users {
+		err = b.backupUser(dir, user, privs[user.name])
+		if err != nil {
+			return err
+		}
+	}
 
 	log.Info("Done backing up users")
 	return nil
@@ -111,24 +118,24 @@ func getUsersToBackup(conn *exasol.Conn) ([]*user, error) {
 	return users, nil
 }
 
-func backupUser(dst string, u *user) error {
+func (b *backupRun) backupUser(dst string, u *user, privs string) error {
 	log.Infof("Backing up user %s", u.name)
 
 	sql := ""
 	if u.kerberos != "" {
 		sql = fmt.Sprintf(
-			"CREATE USER [%s] IDENTIFIED BY KERBEROS PRINCIPAL '%s';\n",
-			u.name, u.kerberos,
+			"CREATE USER %s IDENTIFIED BY KERBEROS PRINCIPAL '%s';\n",
+			b.qb(u.name), qStr(u.kerberos),
 		)
 	} else if u.ldapDN != "" {
 		sql = fmt.Sprintf(
-			"CREATE USER [%s] IDENTIFIED AT LDAP AS '%s';\n",
-			u.name, u.ldapDN,
+			"CREATE USER %s IDENTIFIED AT LDAP AS '%s';\n",
+			b.qb(u.name), qStr(u.ldapDN),
 		)
 	} else if u.openIDSubj != "" {
 		sql = fmt.Sprintf(
-			"CREATE USER [%s] IDENTIFIED BY OPENID SUBJECT '%s';\n",
-			u.name, u.openIDSubj,
+			"CREATE USER %s IDENTIFIED BY OPENID SUBJECT '%s';\n",
+			b.qb(u.name), qStr(u.openIDSubj),
 		)
 	} else {
 		// If the user is setup with a non-LDAP account
@@ -140,30 +147,24 @@ func backupUser(dst string, u *user) error {
 		// in manually later and change the password so in
 		// the meantime we set an invalid password by
 		// setting it to an invalid LDAP distinguished name.
-		sql = fmt.Sprintf("CREATE USER [%s] IDENTIFIED BY ********;\n", u.name)
+		sql = fmt.Sprintf("CREATE USER %s IDENTIFIED BY ********;\n", b.qb(u.name))
 	}
 
-	if u.consumerGroup != "" {
-		if capability.consumerGroups {
-			sql += fmt.Sprintf("ALTER USER [%s] SET CONSUMER_GROUP = [%s];\n", u.name, u.consumerGroup)
-		} else {
-			sql += fmt.Sprintf("GRANT PRIORITY GROUP [%s] TO [%s];\n", u.consumerGroup, u.name)
-		}
-	}
 	if u.comment != "" {
-		sql += fmt.Sprintf("COMMENT ON USER [%s] IS '%s';\n", u.name, qStr(u.comment))
+		sql += fmt.Sprintf("COMMENT ON USER %s IS '%s';\n", b.qb(u.name), qStr(u.comment))
 	}
 	if u.passPolicy != "" {
-		sql += fmt.Sprintf("ALTER USER [%s] SET PASSWORD_EXPIRY_POLICY='%s';\n", u.name, u.passPolicy)
+		sql += fmt.Sprintf("ALTER USER %s SET PASSWORD_EXPIRY_POLICY='%s';\n", b.qb(u.name), u.passPolicy)
 	}
 	if u.passState != "" && u.passState != "VALID" {
-		sql += fmt.Sprintf("ALTER USER [%s] PASSWORD EXPIRE;\n", u.name)
+		sql += fmt.Sprintf("ALTER USER %s PASSWORD EXPIRE;\n", b.qb(u.name))
 	}
 
-	file := filepath.Join(dst, u.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	file := filepath.Join(dst, b.fileName(u.name)+".sql")
+	err := b.writeFile(file, []byte(b.fileHeader(u.name)+sql+privs))
 	if err != nil {
 		return fmt.Errorf("Unable to backup user %s: %s", u.name, err)
 	}
+	b.fileWritten(file)
 	return nil
 }
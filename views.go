@@ -2,10 +2,10 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"sync"
 
 	"github.com/eddyueue/go-exasol-client"
@@ -16,12 +16,20 @@ type view struct {
 	name   string
 	scope  string
 	text   string
+	owner  string
 }
 
 func (v *view) Schema() string { return v.schema }
 func (v *view) Name() string   { return v.name }
 
-func BackupViews(src *exasol.Conn, dst string, crit Criteria, maxRows int, dropExtras bool) error {
+// The schema and name the view is backed up as
+func (v *view) dst(b *backupRun) (string, string) { return b.renamed(VIEWS, v.schema, v.name) }
+
+func BackupViews(src *exasol.Conn, dst string, crit Criteria, maxRows int, dataWhere map[string]string, dropExtras bool) error {
+	return newBackupRun().backupViews(src, dst, crit, maxRows, dataWhere, dropExtras)
+}
+
+func (b *backupRun) backupViews(src *exasol.Conn, dst string, crit Criteria, maxRows int, dataWhere map[string]string, dropExtras bool) error {
 	log.Info("Backing up views")
 
 	views, dbObjs, err := getViewsToBackup(src, crit)
@@ -29,22 +37,67 @@ func BackupViews(src *exasol.Conn, dst string, crit Criteria, maxRows int, dropE
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("views", dbObjs, dst, crit)
+		b.removeExtraObjects(VIEWS, dbObjs, dst, crit)
 	}
+	var selected []*view
+	for _, v := range views {
+		if b.isSelected(v.discovered()) {
+			selected = append(selected, v)
+		}
+	}
+	views = selected
 	if len(views) == 0 {
 		log.Warning("Object criteria did not match any views")
 		return nil
 	}
+	b.countObjects(VIEWS, len(views))
+	b.checkViewConnections(src, views)
+	sort.SliceStable(views, func(i, j int) bool {
+		return b.schemaRank(views[i].schema) < b.schemaRank(views[j].schema)
+	})
 
 	for _, v := range views {
-		dir := filepath.Join(dst, "schemas", v.schema, "views")
+		dstSchema, dstName := v.dst(b)
+		dir := filepath.Join(dst, "schemas", b.fileName(dstSchema), "views")
+		sqlFile := filepath.Join(dir, b.fileName(dstName)+".sql")
+		csvFile := filepath.Join(dir, b.fileName(dstName)+".csv")
+		if !b.option.includeInvalidViews && !isValidView(src, v) {
+			log.Warningf("Skipping invalid view %s.%s", v.schema, v.name)
+			os.Remove(sqlFile)
+			removeDataFiles(csvFile)
+			continue
+		}
 		os.MkdirAll(dir, os.ModePerm)
-		err = backupView(dir, v)
+		err = b.backupView(dir, v)
+		if err != nil {
+			return err
+		}
+		dataFile := filepath.Join("schemas", b.fileName(dstSchema), "views", b.fileName(dstName)+".csv")
+		selectList, where, warnings, err := b.getViewDataQuery(src, v, maxRows, dataWhere)
 		if err != nil {
 			return err
 		}
-		shouldBackup, err := shouldBackupViewData(src, v, maxRows)
+		if b.progress.isDone(dataFile) {
+			log.Infof("Skipping already backed up view data for %s.%s", v.schema, v.name)
+			b.manifest.noteData(dataFile, &dataManifest{Warnings: warnings})
+			continue
+		}
+		shouldBackup, err := b.shouldBackupViewData(src, v, maxRows, where)
 		if err != nil {
+			if b.isMissingObject(src, v.schema, v.name) {
+				log.Warningf("Skipping %s.%s which no longer exists", v.schema, v.name)
+				os.Remove(sqlFile)
+				continue
+			}
+			if !b.option.strict && b.isTimeoutError(err) {
+				log.Warningf("Skipping data of %s.%s which took longer than %s", v.schema, v.name, b.option.objectTimeout)
+				continue
+			}
+			if !b.option.strict && !isValidView(src, v) {
+				log.Warningf("Skipping data of invalid view %s.%s", v.schema, v.name)
+				removeDataFiles(csvFile)
+				continue
+			}
 			return err
 		}
 		if shouldBackup {
@@ -53,14 +106,40 @@ func BackupViews(src *exasol.Conn, dst string, crit Criteria, maxRows int, dropE
 			wg.Add(2)
 			data := make(chan []byte)
 			errors := make(chan error, 2)
-			go readViewData(src, v, data, errors, wg)
-			go writeViewData(dir, v, data, errors, wg)
+			w := b.newCSVWriter(csvFile, b.getCSVFormat(v.schema, v.name))
+			go b.readViewData(src, v, selectList, where, data, errors, wg)
+			go b.writeViewData(w, data, errors, wg)
 			wg.Wait()
 			select {
 			case err = <-errors:
+				// Keep the previous backup's data rather than a partial export
+				w.Abort()
+				if b.isMissingObject(src, v.schema, v.name) {
+					log.Warningf("Skipping %s.%s which no longer exists", v.schema, v.name)
+					os.Remove(sqlFile)
+					removeDataFiles(csvFile)
+					continue
+				}
+				if !b.option.strict && b.isTimeoutError(err) {
+					log.Warningf("Skipping data of %s.%s which took longer than %s", v.schema, v.name, b.option.objectTimeout)
+					continue
+				}
 				return err
 			default:
 			}
+			err = w.Commit()
+			if err != nil {
+				w.Abort()
+				return fmt.Errorf("Unable to write view file %s: %s", csvFile, err)
+			}
+			for _, f := range b.dataFiles(csvFile) {
+				b.fileWritten(f)
+			}
+			b.manifest.noteData(dataFile, &dataManifest{Warnings: warnings})
+			err = b.progress.markDone(dataFile)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -76,7 +155,8 @@ func getViewsToBackup(conn *exasol.Conn, crit Criteria) ([]*view, []dbObj, error
 		SELECT view_schema AS s,
 			   view_name   AS o,
 			   scope_schema,
-			   view_text
+			   view_text,
+			   view_owner
 		FROM exa_all_views
 		WHERE %s
 		ORDER BY local.s, local.o
@@ -94,6 +174,9 @@ func getViewsToBackup(conn *exasol.Conn, crit Criteria) ([]*view, []dbObj, error
 			name:   row[1].(string),
 			text:   row[3].(string),
 		}
+		if row[4] != nil {
+			v.owner = row[4].(string)
+		}
 		if row[2] == nil {
 			v.scope = row[0].(string)
 		} else {
@@ -105,31 +188,144 @@ func getViewsToBackup(conn *exasol.Conn, crit Criteria) ([]*view, []dbObj, error
 	return views, dbObjs, nil
 }
 
-func backupView(dir string, v *view) error {
+type viewConnection struct {
+	view       *view
+	connection string
+}
+
+// Views can IMPORT from a connection which then has to be created
+// before them once restored. This warns about views whose connections
+// aren't part of the backup.
+func (b *backupRun) checkViewConnections(conn *exasol.Conn, views []*view) {
+	var backedUp []string
+	if b.option.connections {
+		res, err := conn.FetchSlice(`SELECT connection_name FROM exa_dba_connections`)
+		if err != nil {
+			log.Warningf("Unable to get connections: %s", err)
+			return
+		}
+		for _, row := range res {
+			backedUp = append(backedUp, row[0].(string))
+		}
+	}
+	for _, vc := range getMissingViewConnections(views, backedUp) {
+		log.Warningf(
+			"View %s.%s imports from connection %s which isn't being backed up",
+			vc.view.schema, vc.view.name, vc.connection,
+		)
+	}
+}
+
+// Returns the connections the views IMPORT from
+// which aren't amongst the given backed up ones.
+func getMissingViewConnections(views []*view, backedUp []string) []viewConnection {
+	have := map[string]bool{}
+	for _, c := range backedUp {
+		have[c] = true
+	}
+	missing := []viewConnection{}
+	for _, v := range views {
+		seen := map[string]bool{}
+		for _, d := range getExternalDependencies(v.text) {
+			if d.Operation != "IMPORT" || d.Connection == "" ||
+				have[d.Connection] || seen[d.Connection] {
+				continue
+			}
+			seen[d.Connection] = true
+			missing = append(missing, viewConnection{v, d.Connection})
+		}
+	}
+	return missing
+}
+
+func (v *view) discovered() DiscoveredObject {
+	return DiscoveredObject{Type: VIEWS, Schema: v.schema, Name: v.name, Owner: v.owner}
+}
+
+func (b *backupRun) backupView(dir string, v *view) error {
 	log.Infof("Backing up view %s.%s", v.schema, v.name)
 
 	// We have to swap out the name too because if the view got renamed
 	// the v.text still references the original name.
+	schema, name := v.dst(b)
 	r := regexp.MustCompile(`^(?is).*?CREATE[^V]+?VIEW\s+("?[\w_-]+"?\.)?"?[\w_-]+"?`)
-	replacement := fmt.Sprintf(`CREATE OR REPLACE FORCE VIEW "%s"."%s"`, v.schema, v.name)
-	createView := r.ReplaceAllString(v.text, replacement)
+	replacement := fmt.Sprintf(`CREATE OR REPLACE FORCE VIEW %s.%s`, b.qd(schema), b.qd(name))
+	createView := r.ReplaceAllLiteralString(v.text, replacement)
 
-	sql := fmt.Sprintf("OPEN SCHEMA [%s];\n%s;\n", v.scope, createView)
-	file := filepath.Join(dir, v.name+".sql")
+	scope := v.scope
+	if scope == v.schema {
+		// Unqualified references are presumably to the view's own schema
+		scope = schema
+	}
+	sql, err := b.transformDDL(VIEWS, v.schema, v.name,
+		fmt.Sprintf("OPEN SCHEMA %s;\n%s;\n", b.qb(scope), createView),
+	)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, b.fileName(name)+".sql")
 
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err = b.writeFile(file, []byte(b.fileHeader(v.schema+"."+v.name)+sql))
 	if err != nil {
 		return fmt.Errorf("Unable to backup view %s: %s", v.name, err)
 	}
+	b.fileWritten(file)
+	b.bundles.add(schema, "views", sql)
 	return nil
 }
 
-func shouldBackupViewData(conn *exasol.Conn, v *view, maxRows int) (bool, error) {
+// Returns the select list and where clause to use for backing up the
+// view's data along with any warnings about it for the manifest
+func (b *backupRun) getViewDataQuery(conn *exasol.Conn, v *view, maxRows int, dataWhere map[string]string) (string, string, []string, error) {
+	if maxRows == 0 || (len(dataWhere) == 0 && b.option.dataQueryTransform == nil &&
+		len(b.option.noDataColumnTypes) == 0 && !b.option.nullUnsupportedTypes) {
+		return "*", "", nil, nil
+	}
+	sql := fmt.Sprintf(`
+		SELECT column_name, column_type
+		FROM exa_all_columns
+		WHERE column_schema = '%s'
+		  AND column_table = '%s'
+		ORDER BY column_ordinal_position
+		`, qStr(v.schema), qStr(v.name),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Unable to get view columns: %s", err)
+	}
+	var cols []Column
+	var colNames []string
+	for _, row := range res {
+		cols = append(cols, Column{Name: row[0].(string), Type: row[1].(string)})
+		colNames = append(colNames, row[0].(string))
+	}
+	selectList, warnings, err := b.getDataSelectList(v.schema, v.name, cols)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return selectList, getDataWhereClause(dataWhere, colNames), warnings, nil
+}
+
+// A view is invalid if it can't be compiled anymore, e.g. because it
+// was created with FORCE or the objects it references were dropped.
+// Its text is still in the catalog though.
+func isValidView(conn *exasol.Conn, v *view) bool {
+	sql := fmt.Sprintf(`SELECT * FROM %s.%s WHERE FALSE`, bracket(v.schema), bracket(v.name))
+	_, err := conn.FetchSlice(sql)
+	return err == nil
+}
+
+func (b *backupRun) shouldBackupViewData(conn *exasol.Conn, v *view, maxRows int, where string) (bool, error) {
 	if maxRows == 0 {
 		return false, nil
 	}
-	sql := fmt.Sprintf(`SELECT COUNT(*) FROM [%s].[%s]`, v.schema, v.name)
+	sql := fmt.Sprintf(`SELECT COUNT(*) FROM %s.%s%s`, bracket(v.schema), bracket(v.name), where)
+	resetTimeout, err := b.setObjectTimeout(conn)
+	if err != nil {
+		return false, err
+	}
 	res, err := conn.FetchSlice(sql)
+	resetTimeout()
 	if err != nil {
 		return false, fmt.Errorf("Unable to number of view rows: %s", err)
 	}
@@ -137,17 +333,23 @@ func shouldBackupViewData(conn *exasol.Conn, v *view, maxRows int) (bool, error)
 	return numRows > 0 && numRows <= maxRows, nil
 }
 
-func readViewData(conn *exasol.Conn, v *view, data chan<- []byte, errors chan<- error, wg *sync.WaitGroup) {
+func (b *backupRun) readViewData(conn *exasol.Conn, v *view, selectList, where string, data chan<- []byte, errors chan<- error, wg *sync.WaitGroup) {
 	defer func() {
 		close(data)
 		wg.Done()
 	}()
 
 	exportSQL := fmt.Sprintf(
-		"EXPORT (SELECT * FROM [%s].[%s]) INTO CSV AT '%%s' FILE 'data.csv'",
-		v.schema, v.name,
+		"EXPORT (SELECT %s FROM %s.%s%s) INTO CSV AT '%%s' FILE 'data.csv'%s",
+		selectList, bracket(v.schema), bracket(v.name), where, b.getDataExportHint(v.schema, v.name),
 	)
-	res := conn.StreamQuery(exportSQL)
+	resetTimeout, err := b.setObjectTimeout(conn)
+	if err != nil {
+		errors <- err
+		return
+	}
+	defer resetTimeout()
+	res := streamQuery(conn, exportSQL)
 	if res.Error != nil {
 		errors <- fmt.Errorf("Unable to read view %s: %s", v.name, res.Error)
 		return
@@ -157,20 +359,19 @@ func readViewData(conn *exasol.Conn, v *view, data chan<- []byte, errors chan<-
 	}
 }
 
-func writeViewData(dst string, v *view, data <-chan []byte, errors chan<- error, wg *sync.WaitGroup) {
-	defer func() { wg.Done() }()
-	fp := filepath.Join(dst, v.name+".csv")
-	f, err := os.Create(fp)
-	if err != nil {
-		errors <- fmt.Errorf("Unable to create view file %s: %s", fp, err)
-		return
-	}
+// The caller commits (or aborts) the writer once the read is done too
+func (b *backupRun) writeViewData(w *csvWriter, data <-chan []byte, errors chan<- error, wg *sync.WaitGroup) {
+	defer func() {
+		// Keep consuming so the reader isn't left blocked
+		for range data {
+		}
+		wg.Done()
+	}()
 	for d := range data {
-		_, err = f.Write(d)
+		_, err := w.Write(d)
 		if err != nil {
-			errors <- fmt.Errorf("Unable to write view file %s: %s", fp, err)
+			errors <- fmt.Errorf("Unable to write view file %s: %s", w.csvFile, err)
 			return
 		}
 	}
-	f.Close()
 }